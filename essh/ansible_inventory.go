@@ -0,0 +1,609 @@
+package essh
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	INVENTORY_FORMAT_ANSIBLE      = "ansible"
+	INVENTORY_FORMAT_ANSIBLE_YAML = "ansible-yaml"
+)
+
+// ansibleHostVars maps the ssh config of hosts to the variables of ansible.
+var ansibleHostVars = []struct {
+	SSHConfig string
+	Var       string
+}{
+	{"HostName", "ansible_host"},
+	{"Port", "ansible_port"},
+	{"User", "ansible_user"},
+	{"IdentityFile", "ansible_ssh_private_key_file"},
+}
+
+var ansibleProxyJumpRegexp = regexp.MustCompile(`(?:ProxyJump=|-J\s*)(\S+)`)
+
+var ansibleInvalidNameCharsRegexp = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// ansibleName converts the tag or the prop's key to a valid name of a group or a variable of ansible.
+func ansibleName(s string) string {
+	return ansibleInvalidNameCharsRegexp.ReplaceAllString(s, "_")
+}
+
+// ansibleVars returns the variables of the host. props become variables, and the ssh config becomes ansible_* variables.
+func ansibleVars(host *Host) map[string]string {
+	vars := map[string]string{}
+	for key, value := range host.Props {
+		vars[ansibleName(key)] = value
+	}
+
+	config := effectiveSSHConfig(host.Name)
+	for _, v := range ansibleHostVars {
+		if value := sshConfigValue(config, v.SSHConfig); value != "" {
+			vars[v.Var] = value
+		}
+	}
+	if proxyJump := sshConfigValue(config, "ProxyJump"); proxyJump != "" {
+		vars["ansible_ssh_common_args"] = "-o ProxyJump=" + proxyJump
+	}
+
+	return vars
+}
+
+// ansibleGroups returns the hosts' names keyed by the group names that are made from the tags.
+func ansibleGroups(hosts []*Host) (map[string][]string, []string) {
+	groups := map[string][]string{}
+	names := []string{}
+	for _, host := range hosts {
+		for _, tag := range host.Tags {
+			group := ansibleName(tag)
+			if _, ok := groups[group]; !ok {
+				names = append(names, group)
+			}
+			groups[group] = append(groups[group], host.Name)
+		}
+	}
+	sort.Strings(names)
+
+	return groups, names
+}
+
+// GenAnsibleInventory generates an ansible inventory of the hosts in the format 'ansible' (INI) or 'ansible-yaml'.
+func GenAnsibleInventory(hosts []*Host, format string) ([]byte, error) {
+	switch format {
+	case INVENTORY_FORMAT_ANSIBLE:
+		return genAnsibleINIInventory(hosts), nil
+	case INVENTORY_FORMAT_ANSIBLE_YAML:
+		return genAnsibleYAMLInventory(hosts)
+	}
+
+	return nil, fmt.Errorf("unsupported inventory format '%s'. it must be '%s' or '%s'.", format, INVENTORY_FORMAT_ANSIBLE, INVENTORY_FORMAT_ANSIBLE_YAML)
+}
+
+func genAnsibleINIInventory(hosts []*Host) []byte {
+	var b bytes.Buffer
+	fmt.Fprint(&b, "# generated by essh\n")
+	for _, host := range hosts {
+		fmt.Fprint(&b, host.Name)
+
+		vars := ansibleVars(host)
+		keys := []string{}
+		for key := range vars {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&b, " %s=%s", key, ansibleINIQuote(vars[key]))
+		}
+		fmt.Fprint(&b, "\n")
+	}
+
+	groups, names := ansibleGroups(hosts)
+	for _, group := range names {
+		fmt.Fprintf(&b, "\n[%s]\n", group)
+		for _, name := range groups[group] {
+			fmt.Fprintf(&b, "%s\n", name)
+		}
+	}
+
+	return b.Bytes()
+}
+
+func ansibleINIQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"'#;=\\") {
+		return s
+	}
+
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
+
+func genAnsibleYAMLInventory(hosts []*Host) ([]byte, error) {
+	allHosts := map[string]map[string]string{}
+	for _, host := range hosts {
+		allHosts[host.Name] = ansibleVars(host)
+	}
+
+	all := map[string]interface{}{"hosts": allHosts}
+
+	groups, names := ansibleGroups(hosts)
+	if len(names) > 0 {
+		children := map[string]interface{}{}
+		for _, group := range names {
+			groupHosts := map[string]map[string]string{}
+			for _, name := range groups[group] {
+				groupHosts[name] = map[string]string{}
+			}
+			children[group] = map[string]interface{}{"hosts": groupHosts}
+		}
+		all["children"] = children
+	}
+
+	b, err := yaml.Marshal(map[string]interface{}{"all": all})
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte("# generated by essh\n"), b...), nil
+}
+
+// ansibleInventory is a parsed ansible inventory.
+type ansibleInventory struct {
+	hostVars  map[string]map[string]string
+	hostNames []string
+	groups    map[string]*ansibleGroup
+}
+
+type ansibleGroup struct {
+	vars     map[string]string
+	hosts    []string
+	children []string
+}
+
+func newAnsibleInventory() *ansibleInventory {
+	return &ansibleInventory{
+		hostVars: map[string]map[string]string{},
+		groups:   map[string]*ansibleGroup{},
+	}
+}
+
+func (inv *ansibleInventory) group(name string) *ansibleGroup {
+	g, ok := inv.groups[name]
+	if !ok {
+		g = &ansibleGroup{vars: map[string]string{}}
+		inv.groups[name] = g
+	}
+	return g
+}
+
+func (inv *ansibleInventory) addHost(group string, name string, vars map[string]string) {
+	hv, ok := inv.hostVars[name]
+	if !ok {
+		hv = map[string]string{}
+		inv.hostVars[name] = hv
+		inv.hostNames = append(inv.hostNames, name)
+	}
+	for k, v := range vars {
+		hv[k] = v
+	}
+
+	g := inv.group(group)
+	for _, h := range g.hosts {
+		if h == name {
+			return
+		}
+	}
+	g.hosts = append(g.hosts, name)
+}
+
+// hostGroups returns the groups of the host including the parent groups except 'all' and 'ungrouped'.
+// The groups are sorted by the depth and the name, so the vars of the latter ones override the former ones like ansible.
+func (inv *ansibleInventory) hostGroups(name string) []string {
+	parents := map[string][]string{}
+	for groupName, g := range inv.groups {
+		for _, child := range g.children {
+			parents[child] = append(parents[child], groupName)
+		}
+	}
+
+	// depth is the length of the longest path from the top level groups.
+	depths := map[string]int{}
+	var depth func(group string, visiting map[string]bool) int
+	depth = func(group string, visiting map[string]bool) int {
+		if d, ok := depths[group]; ok {
+			return d
+		}
+		if visiting[group] {
+			// a cycle of children
+			return 0
+		}
+		visiting[group] = true
+
+		d := 0
+		for _, parent := range parents[group] {
+			if pd := depth(parent, visiting) + 1; pd > d {
+				d = pd
+			}
+		}
+		depths[group] = d
+		return d
+	}
+
+	found := map[string]bool{}
+	var addGroup func(group string)
+	addGroup = func(group string) {
+		if found[group] {
+			return
+		}
+		found[group] = true
+		for _, parent := range parents[group] {
+			addGroup(parent)
+		}
+	}
+	for groupName, g := range inv.groups {
+		for _, h := range g.hosts {
+			if h == name {
+				addGroup(groupName)
+			}
+		}
+	}
+
+	groups := []string{}
+	for group := range found {
+		if group != "all" && group != "ungrouped" {
+			groups = append(groups, group)
+			depth(group, map[string]bool{})
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if depths[groups[i]] != depths[groups[j]] {
+			return depths[groups[i]] < depths[groups[j]]
+		}
+		return groups[i] < groups[j]
+	})
+
+	return groups
+}
+
+// parseAnsibleInventory parses the ansible inventory file in the INI or YAML format.
+// YAML is used for the files that have '.yml', '.yaml' or '.json' extension.
+func parseAnsibleInventory(path string) (*ansibleInventory, error) {
+	b, err := os.ReadFile(expandHomeDir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml", ".json":
+		return parseAnsibleYAMLInventory(b)
+	}
+
+	return parseAnsibleINIInventory(b)
+}
+
+func parseAnsibleINIInventory(b []byte) (*ansibleInventory, error) {
+	inv := newAnsibleInventory()
+	section, kind := "ungrouped", "hosts"
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section, kind = line[1:len(line)-1], "hosts"
+			if i := strings.Index(section, ":"); i >= 0 {
+				section, kind = section[:i], section[i+1:]
+			}
+			if kind != "hosts" && kind != "vars" && kind != "children" {
+				return nil, fmt.Errorf("line %d: invalid section '%s'", n, line)
+			}
+			inv.group(section)
+			continue
+		}
+
+		fields, err := splitAnsibleINILine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+
+		switch kind {
+		case "vars":
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				return nil, fmt.Errorf("line %d: a variable must be like key=value", n)
+			}
+			inv.group(section).vars[strings.TrimSpace(key)] = unquoteAnsibleValue(strings.TrimSpace(value))
+		case "children":
+			inv.group(section).children = append(inv.group(section).children, fields[0])
+			inv.group(fields[0])
+		default:
+			vars := map[string]string{}
+			for _, field := range fields[1:] {
+				key, value, ok := strings.Cut(field, "=")
+				if !ok {
+					return nil, fmt.Errorf("line %d: a host variable must be like key=value: %s", n, field)
+				}
+				vars[key] = value
+			}
+			names, err := expandAnsibleHostPattern(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			for _, name := range names {
+				inv.addHost(section, name, vars)
+			}
+		}
+	}
+
+	return inv, scanner.Err()
+}
+
+// splitAnsibleINILine splits the line by spaces like shlex. Quoted values can contain spaces.
+func splitAnsibleINILine(line string) ([]string, error) {
+	fields := []string{}
+	var field strings.Builder
+	var quote rune
+	escaped := false
+	inField := false
+	for _, c := range line {
+		switch {
+		case escaped:
+			field.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				field.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inField = true
+		case c == '#' && !inField:
+			// a comment at the end of the line
+			return fields, nil
+		case c == ' ' || c == '\t':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(c)
+			inField = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+
+	return fields, nil
+}
+
+func unquoteAnsibleValue(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+var ansibleHostRangeRegexp = regexp.MustCompile(`\[([0-9]+|[a-zA-Z]):([0-9]+|[a-zA-Z])(?::([0-9]+))?\]`)
+
+// expandAnsibleHostPattern expands a numeric range like `web[01:03]`, an alphabetic range like `db-[a:c]`
+// and a range with a step like `web[1:9:2]`.
+func expandAnsibleHostPattern(pattern string) ([]string, error) {
+	m := ansibleHostRangeRegexp.FindStringSubmatchIndex(pattern)
+	if m == nil {
+		return []string{pattern}, nil
+	}
+
+	startStr, endStr := pattern[m[2]:m[3]], pattern[m[4]:m[5]]
+	step := 1
+	if m[6] >= 0 {
+		step, _ = strconv.Atoi(pattern[m[6]:m[7]])
+	}
+
+	var values []string
+	start, err1 := strconv.Atoi(startStr)
+	end, err2 := strconv.Atoi(endStr)
+	switch {
+	case err1 == nil && err2 == nil:
+		if start > end || step < 1 {
+			return nil, fmt.Errorf("invalid range: %s", pattern)
+		}
+		for i := start; i <= end; i += step {
+			num := strconv.Itoa(i)
+			if len(startStr) > 1 && startStr[0] == '0' {
+				num = fmt.Sprintf("%0*d", len(startStr), i)
+			}
+			values = append(values, num)
+		}
+	case err1 != nil && err2 != nil:
+		if startStr[0] > endStr[0] || step < 1 {
+			return nil, fmt.Errorf("invalid range: %s", pattern)
+		}
+		for c := int(startStr[0]); c <= int(endStr[0]); c += step {
+			values = append(values, string(rune(c)))
+		}
+	default:
+		return nil, fmt.Errorf("invalid range: %s", pattern)
+	}
+
+	rest, err := expandAnsibleHostPattern(pattern[m[1]:])
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, v := range values {
+		for _, r := range rest {
+			names = append(names, pattern[:m[0]]+v+r)
+		}
+	}
+
+	return names, nil
+}
+
+func parseAnsibleYAMLInventory(b []byte) (*ansibleInventory, error) {
+	root := map[string]interface{}{}
+	if err := yaml.Unmarshal(b, &root); err != nil {
+		return nil, err
+	}
+
+	inv := newAnsibleInventory()
+	var parseGroup func(name string, value interface{}) error
+	parseGroup = func(name string, value interface{}) error {
+		g := inv.group(name)
+		if value == nil {
+			return nil
+		}
+		node, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return fmt.Errorf("group '%s' must be a mapping", name)
+		}
+
+		if vars, ok := node["vars"].(map[interface{}]interface{}); ok {
+			for k, v := range vars {
+				g.vars[fmt.Sprint(k)] = ansibleYAMLValue(v)
+			}
+		}
+		if hosts, ok := node["hosts"].(map[interface{}]interface{}); ok {
+			for k, v := range hosts {
+				vars := map[string]string{}
+				if hv, ok := v.(map[interface{}]interface{}); ok {
+					for vk, vv := range hv {
+						vars[fmt.Sprint(vk)] = ansibleYAMLValue(vv)
+					}
+				}
+				names, err := expandAnsibleHostPattern(fmt.Sprint(k))
+				if err != nil {
+					return err
+				}
+				for _, hostName := range names {
+					inv.addHost(name, hostName, vars)
+				}
+			}
+		}
+		if children, ok := node["children"].(map[interface{}]interface{}); ok {
+			for k, v := range children {
+				child := fmt.Sprint(k)
+				g.children = append(g.children, child)
+				if err := parseGroup(child, v); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	for k, v := range root {
+		if err := parseGroup(k, v); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(inv.hostNames)
+
+	return inv, nil
+}
+
+func ansibleYAMLValue(v interface{}) string {
+	switch v.(type) {
+	case string, int, float64, bool:
+		return fmt.Sprint(v)
+	case nil:
+		return ""
+	}
+
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// registerAnsibleInventoryHosts registers the hosts of the inventory.
+// The groups become tags, ansible_* variables become the ssh config, and the other variables become props.
+func registerAnsibleInventoryHosts(L *lua.LState, inv *ansibleInventory) *lua.LTable {
+	hostsTb := L.NewTable()
+	for _, name := range inv.hostNames {
+		groups := inv.hostGroups(name)
+
+		vars := map[string]string{}
+		for _, group := range append([]string{"all"}, groups...) {
+			if g, ok := inv.groups[group]; ok {
+				for k, v := range g.vars {
+					vars[k] = v
+				}
+			}
+		}
+		for k, v := range inv.hostVars[name] {
+			vars[k] = v
+		}
+
+		h := registerHost(L, name)
+
+		props := L.NewTable()
+		for key, value := range vars {
+			switch key {
+			case "ansible_host", "ansible_ssh_host":
+				updateHost(L, h, "HostName", lua.LString(value))
+			case "ansible_port", "ansible_ssh_port":
+				updateHost(L, h, "Port", lua.LString(value))
+			case "ansible_user", "ansible_ssh_user":
+				updateHost(L, h, "User", lua.LString(value))
+			case "ansible_ssh_private_key_file":
+				updateHost(L, h, "IdentityFile", lua.LString(value))
+			case "ansible_ssh_common_args":
+				if m := ansibleProxyJumpRegexp.FindStringSubmatch(value); m != nil {
+					updateHost(L, h, "ProxyJump", lua.LString(m[1]))
+				}
+			default:
+				props.RawSetString(key, lua.LString(value))
+			}
+		}
+		updateHost(L, h, "props", props)
+
+		tags := L.NewTable()
+		for _, group := range groups {
+			tags.Append(lua.LString(group))
+		}
+		updateHost(L, h, "tags", tags)
+
+		hostsTb.RawSetString(name, newLHost(L, h))
+	}
+
+	return hostsTb
+}
+
+// esshLoadAnsibleInventory registers the hosts of the ansible inventory file, and returns a table of them keyed by the names.
+func esshLoadAnsibleInventory(L *lua.LState) int {
+	path := L.CheckString(1)
+
+	inv, err := parseAnsibleInventory(path)
+	if err != nil {
+		L.RaiseError("failed to load the ansible inventory '%s': %v", path, err)
+	}
+
+	L.Push(registerAnsibleInventoryHosts(L, inv))
+	return 1
+}
@@ -0,0 +1,225 @@
+package essh
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandAnsibleHostPattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		names   []string
+		err     bool
+	}{
+		{pattern: "web01", names: []string{"web01"}},
+		{pattern: "web[1:3]", names: []string{"web1", "web2", "web3"}},
+		{pattern: "web[08:10]", names: []string{"web08", "web09", "web10"}},
+		{pattern: "web[01:10]", names: []string{"web01", "web02", "web03", "web04", "web05", "web06", "web07", "web08", "web09", "web10"}},
+		{pattern: "web[1:9:4].example.com", names: []string{"web1.example.com", "web5.example.com", "web9.example.com"}},
+		{pattern: "db-[a:c]", names: []string{"db-a", "db-b", "db-c"}},
+		{pattern: "r[1:2]-[a:b]", names: []string{"r1-a", "r1-b", "r2-a", "r2-b"}},
+		{pattern: "web[3:1]", err: true},
+		{pattern: "db-[c:a]", err: true},
+		{pattern: "web[1:c]", err: true},
+		{pattern: "web[1:3:0]", err: true},
+	}
+
+	for _, c := range cases {
+		names, err := expandAnsibleHostPattern(c.pattern)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, but got %v", c.pattern, names)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.pattern, err)
+			continue
+		}
+		if !reflect.DeepEqual(names, c.names) {
+			t.Errorf("%s: expected %v, but got %v", c.pattern, c.names, names)
+		}
+	}
+}
+
+func TestParseAnsibleINIInventory(t *testing.T) {
+	inv, err := parseAnsibleINIInventory([]byte(`# comment
+bastion ansible_host=192.168.0.1
+
+[web]
+web[01:10] ansible_user=deploy
+web01 ansible_host="10.0.0.1" # the first web server
+
+[db]
+db-[a:c]
+
+[prod:children]
+web
+db
+
+[prod:vars]
+env = production
+motd="hello world"
+
+[web:vars]
+env=web
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedNames := []string{"bastion", "web01", "web02", "web03", "web04", "web05", "web06", "web07", "web08", "web09", "web10", "db-a", "db-b", "db-c"}
+	if !reflect.DeepEqual(inv.hostNames, expectedNames) {
+		t.Errorf("expected hosts %v, but got %v", expectedNames, inv.hostNames)
+	}
+
+	hostVars := map[string]map[string]string{
+		"bastion": {"ansible_host": "192.168.0.1"},
+		"web01":   {"ansible_user": "deploy", "ansible_host": "10.0.0.1"},
+		"web10":   {"ansible_user": "deploy"},
+		"db-b":    {},
+	}
+	for name, expected := range hostVars {
+		if vars := inv.hostVars[name]; !reflect.DeepEqual(vars, expected) {
+			t.Errorf("%s: expected vars %v, but got %v", name, expected, vars)
+		}
+	}
+
+	hostGroups := map[string][]string{
+		"bastion": {},
+		"web05":   {"prod", "web"},
+		"db-c":    {"prod", "db"},
+	}
+	for name, expected := range hostGroups {
+		if groups := inv.hostGroups(name); !reflect.DeepEqual(groups, expected) {
+			t.Errorf("%s: expected groups %v, but got %v", name, expected, groups)
+		}
+	}
+
+	if expected := []string{"web", "db"}; !reflect.DeepEqual(inv.groups["prod"].children, expected) {
+		t.Errorf("expected children %v, but got %v", expected, inv.groups["prod"].children)
+	}
+	if expected := map[string]string{"env": "production", "motd": "hello world"}; !reflect.DeepEqual(inv.groups["prod"].vars, expected) {
+		t.Errorf("expected prod vars %v, but got %v", expected, inv.groups["prod"].vars)
+	}
+	if expected := map[string]string{"env": "web"}; !reflect.DeepEqual(inv.groups["web"].vars, expected) {
+		t.Errorf("expected web vars %v, but got %v", expected, inv.groups["web"].vars)
+	}
+}
+
+func TestParseAnsibleINIInventoryErrors(t *testing.T) {
+	cases := []struct {
+		desc    string
+		content string
+	}{
+		{desc: "invalid section", content: "[web:unknown]\nweb01\n"},
+		{desc: "invalid variable", content: "[web:vars]\nenv\n"},
+		{desc: "invalid host variable", content: "web01 ansible_host\n"},
+		{desc: "unterminated quote", content: "web01 ansible_host=\"10.0.0.1\n"},
+		{desc: "invalid range", content: "web[3:1]\n"},
+	}
+
+	for _, c := range cases {
+		if _, err := parseAnsibleINIInventory([]byte(c.content)); err == nil {
+			t.Errorf("%s: expected an error, but got nil", c.desc)
+		}
+	}
+}
+
+func TestParseAnsibleYAMLInventory(t *testing.T) {
+	inv, err := parseAnsibleYAMLInventory([]byte(`all:
+  hosts:
+    bastion:
+      ansible_host: 192.168.0.1
+  children:
+    prod:
+      vars:
+        env: production
+      children:
+        web:
+          hosts:
+            web[1:3]:
+              ansible_port: 2222
+        db:
+          hosts:
+            db-[a:b]:
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedNames := []string{"bastion", "db-a", "db-b", "web1", "web2", "web3"}
+	if !reflect.DeepEqual(inv.hostNames, expectedNames) {
+		t.Errorf("expected hosts %v, but got %v", expectedNames, inv.hostNames)
+	}
+	if expected := map[string]string{"ansible_port": "2222"}; !reflect.DeepEqual(inv.hostVars["web2"], expected) {
+		t.Errorf("expected vars %v, but got %v", expected, inv.hostVars["web2"])
+	}
+	if expected := []string{"prod", "web"}; !reflect.DeepEqual(inv.hostGroups("web3"), expected) {
+		t.Errorf("expected groups %v, but got %v", expected, inv.hostGroups("web3"))
+	}
+	if expected := []string{"prod", "db"}; !reflect.DeepEqual(inv.hostGroups("db-a"), expected) {
+		t.Errorf("expected groups %v, but got %v", expected, inv.hostGroups("db-a"))
+	}
+	if expected := map[string]string{"env": "production"}; !reflect.DeepEqual(inv.groups["prod"].vars, expected) {
+		t.Errorf("expected prod vars %v, but got %v", expected, inv.groups["prod"].vars)
+	}
+}
+
+func TestAnsibleInventoryRoundTrip(t *testing.T) {
+	saved := Hosts
+	defer func() { Hosts = saved }()
+
+	web := newTestHost("web01", []string{"web", "production"}, map[string]string{"role": "app server"})
+	web.SSHConfig = map[string]string{"HostName": "10.0.0.1", "Port": "2222", "User": "deploy"}
+
+	db := newTestHost("db01", []string{"db"}, nil)
+	db.SSHConfig = map[string]string{"HostName": "10.0.0.2", "ProxyJump": "bastion"}
+
+	Hosts = map[string]*Host{web.Name: web, db.Name: db}
+	hosts := []*Host{web, db}
+
+	expectedVars := map[string]map[string]string{
+		"web01": {"ansible_host": "10.0.0.1", "ansible_port": "2222", "ansible_user": "deploy", "role": "app server"},
+		"db01":  {"ansible_host": "10.0.0.2", "ansible_ssh_common_args": "-o ProxyJump=bastion"},
+	}
+	expectedGroups := map[string][]string{
+		"web01": {"production", "web"},
+		"db01":  {"db"},
+	}
+
+	for _, format := range []string{INVENTORY_FORMAT_ANSIBLE, INVENTORY_FORMAT_ANSIBLE_YAML} {
+		b, err := GenAnsibleInventory(hosts, format)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", format, err)
+		}
+
+		var inv *ansibleInventory
+		if format == INVENTORY_FORMAT_ANSIBLE {
+			inv, err = parseAnsibleINIInventory(b)
+		} else {
+			inv, err = parseAnsibleYAMLInventory(b)
+		}
+		if err != nil {
+			t.Fatalf("%s: failed to parse the generated inventory: %v\n%s", format, err, b)
+		}
+
+		for name, expected := range expectedVars {
+			if vars := inv.hostVars[name]; !reflect.DeepEqual(vars, expected) {
+				t.Errorf("%s: %s: expected vars %v, but got %v", format, name, expected, vars)
+			}
+		}
+		for name, expected := range expectedGroups {
+			if groups := inv.hostGroups(name); !reflect.DeepEqual(groups, expected) {
+				t.Errorf("%s: %s: expected groups %v, but got %v", format, name, expected, groups)
+			}
+		}
+		if len(inv.hostNames) != len(hosts) {
+			t.Errorf("%s: expected %d hosts, but got %v", format, len(hosts), inv.hostNames)
+		}
+	}
+
+	if _, err := GenAnsibleInventory(hosts, "json"); err == nil {
+		t.Errorf("expected an error for the unsupported format")
+	}
+}
@@ -10,6 +10,10 @@ _essh_tasks() {
     COMPREPLY=( $(compgen -W "$({{.Executable}} --bash-completion-tasks)" -- $cur) )
 }
 
+_essh_task_params() {
+    COMPREPLY=( $(compgen -W "$({{.Executable}} --bash-completion-tasks "$1")" -- $cur) )
+}
+
 _essh_hosts_and_tasks() {
     COMPREPLY=( $(compgen -W "$({{.Executable}} --bash-completion-hosts) $({{.Executable}} --bash-completion-tasks)" -- $cur) )
 }
@@ -86,6 +90,9 @@ _essh_options() {
         --no-color
         --gen
         --global
+        --refresh-inventory
+        --import-ssh-config
+        --export-inventory
         --working-dir
         --config
         --hosts
@@ -159,6 +166,11 @@ _essh() {
                         _essh_tasks_options
                     elif [ "$tagsMode" = "on" ]; then
                         _essh_tags_options
+                    elif [[ "${COMP_WORDS[1]}" != -* ]]; then
+                        _essh_task_params "${COMP_WORDS[1]}"
+                        local params=("${COMPREPLY[@]}")
+                        _essh_options
+                        COMPREPLY=("${params[@]}" "${COMPREPLY[@]}")
                     else
                         _essh_options
                     fi
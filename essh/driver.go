@@ -116,6 +116,12 @@ export ESSH_DEBUG="{{if .Debug}}1{{end}}"
 {{range $key, $value := .Task.Props -}}
 export ESSH_TASK_PROPS_{{$key | ToUpper | EnvKeyEscape}}={{$value | ShellEscape }}
 {{end -}}
+{{range $key, $value := .Task.EnvironFor .Host -}}
+export {{$key}}={{$value | ShellEscape }}
+{{end -}}
+{{range $key, $value := .Task.ParamValues -}}
+export ESSH_TASK_PARAM_{{$key | ToUpper | EnvKeyEscape}}={{$value | ShellEscape }}
+{{end -}}
 {{range $index, $value := .Task.Args -}}
 export ESSH_TASK_ARGS_{{Add $index 1 }}={{$value | ShellEscape }}
 {{end -}}
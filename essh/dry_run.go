@@ -0,0 +1,116 @@
+package essh
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/sevir/essh/support/color"
+)
+
+// dryRunTaskScripts prints the scripts and the commands that would run the task on the target hosts without running them.
+func dryRunTaskScripts(w io.Writer, config string, task *Task) error {
+	hosts := selectTaskHosts(task)
+	for _, host := range task.SkippedHosts {
+		fmt.Fprint(w, color.FgYB("=== %s on %s (skipped by when) ===\n", task.Name, host.Name))
+	}
+	if len(hosts) == 0 && len(task.SkippedHosts) > 0 {
+		return nil
+	}
+
+	if len(hosts) == 0 {
+		if task.IsRemoteTask() || len(task.Targets) >= 1 {
+			return fmt.Errorf("There are not hosts to run the command. you must specify the valid hosts.")
+		}
+
+		if len(task.Upload) > 0 || len(task.Download) > 0 {
+			return fmt.Errorf("task '%s' has upload or download, but it doesn't have target hosts.", task.Name)
+		}
+
+		// local no host task
+		hosts = []*Host{nil}
+	}
+
+	for _, host := range hosts {
+		var c *taskCommand
+		var err error
+		if task.IsRemoteTask() {
+			c, err = newRemoteTaskCommand(config, task, host)
+		} else {
+			c, err = newLocalTaskCommand(config, task, host)
+		}
+		if err != nil {
+			return err
+		}
+
+		hostname := "local"
+		if host != nil {
+			hostname = host.Name
+		}
+
+		fmt.Fprint(w, color.FgCB("=== %s on %s (%s) ===\n", task.Name, hostname, task.Backend))
+		if err := printFileTransfers(w, "upload", task.Upload, task, host); err != nil {
+			return err
+		}
+		printTextSection(w, "script", c.Content)
+		if c.Script != c.Content {
+			printTextSection(w, "wrapped script", c.Script)
+		}
+		if task.IsRemoteTask() && taskTransport(task, host) == TRANSPORT_NATIVE {
+			printTextSection(w, "native command", nativeCommand(c.Script))
+		} else {
+			printTextSection(w, "command", shellJoin(c.Args))
+		}
+		if err := printFileTransfers(w, "download", task.Download, task, host); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+	}
+
+	return nil
+}
+
+func printFileTransfers(w io.Writer, op string, transfers []*FileTransfer, task *Task, host *Host) error {
+	lines := []string{}
+	for _, t := range transfers {
+		src, dest, err := renderFileTransfer(t, task, host)
+		if err != nil {
+			return err
+		}
+
+		if op == "upload" {
+			dest = host.Name + ":" + dest
+		} else {
+			src = host.Name + ":" + src
+		}
+
+		line := src + " -> " + dest
+		if t.Mode != "" {
+			line += " (mode " + t.Mode + ")"
+		}
+		lines = append(lines, line)
+	}
+
+	if len(lines) > 0 {
+		printTextSection(w, op, strings.Join(lines, "\n"))
+	}
+
+	return nil
+}
+
+var shellSafeRegexp = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellJoin joins the args into a command line that can be pasted to a shell.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if shellSafeRegexp.MatchString(arg) {
+			quoted[i] = arg
+		} else {
+			quoted[i] = ShellEscape(arg)
+		}
+	}
+
+	return strings.Join(quoted, " ")
+}
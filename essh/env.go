@@ -0,0 +1,117 @@
+package essh
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var envKeyRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// toEnv converts a table of environment variables. A value is a string or a function that returns the value at run time.
+func toEnv(L *lua.LState, value lua.LValue) map[string]interface{} {
+	tb, ok := toLTable(value)
+	if !ok {
+		L.RaiseError("env must be a table.")
+	}
+
+	env := map[string]interface{}{}
+	tb.ForEach(func(k lua.LValue, v lua.LValue) {
+		key, ok := toString(k)
+		if !ok || !envKeyRegexp.MatchString(key) {
+			L.RaiseError("env table's key must be a valid environment variable name: %v", k)
+		}
+
+		switch lv := v.(type) {
+		case lua.LString, lua.LNumber, lua.LBool:
+			env[key] = lv.String()
+		case *lua.LFunction:
+			env[key] = lv
+		default:
+			L.RaiseError("env table's value must be a string or a function: %s", key)
+		}
+	})
+
+	return env
+}
+
+// parseEnvOption parses the value of the --env option like `KEY=VALUE`.
+func parseEnvOption(s string) (string, string, error) {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || !envKeyRegexp.MatchString(key) {
+		return "", "", fmt.Errorf("--env must be like KEY=VALUE: %s", s)
+	}
+
+	return key, value, nil
+}
+
+// resolveEnv returns the values of the environment variables calling the functions.
+func resolveEnv(L *lua.LState, env map[string]interface{}) (map[string]string, error) {
+	values := map[string]string{}
+	for key, value := range env {
+		if fn, ok := value.(*lua.LFunction); ok {
+			err := L.CallByParam(lua.P{
+				Fn:      fn,
+				NRet:    1,
+				Protect: true,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("env '%s': %v", key, err)
+			}
+
+			ret := L.Get(-1)
+			L.Pop(1)
+
+			switch ret.(type) {
+			case lua.LString, lua.LNumber, lua.LBool:
+				values[key] = ret.String()
+			default:
+				return nil, fmt.Errorf("env '%s': the function must return a string.", key)
+			}
+		} else if s, ok := value.(string); ok {
+			values[key] = s
+		}
+	}
+
+	return values, nil
+}
+
+// resolveTaskEnv resolves the environment variables for each target host of the task.
+// The host's env is overridden by the task's env, and the task's env is overridden by the --env option.
+// It must be called in the goroutine that can use the lua state.
+func resolveTaskEnv(task *Task, L *lua.LState) error {
+	taskEnv, err := resolveEnv(L, task.Env)
+	if err != nil {
+		return fmt.Errorf("task '%s' failed to resolve %v", task.Name, err)
+	}
+	for key, value := range envVar {
+		taskEnv[key] = value
+	}
+
+	task.Environ = map[string]map[string]string{"": taskEnv}
+	for _, host := range selectTaskHosts(task) {
+		hostEnv, err := resolveEnv(L, host.Env)
+		if err != nil {
+			return fmt.Errorf("host '%s' failed to resolve %v", host.Name, err)
+		}
+		for key, value := range taskEnv {
+			hostEnv[key] = value
+		}
+		task.Environ[host.Name] = hostEnv
+	}
+
+	return nil
+}
+
+// EnvironFor returns the environment variables resolved for the host. host is nil for a task without hosts.
+func (t *Task) EnvironFor(host *Host) map[string]string {
+	if host != nil {
+		if env, ok := t.Environ[host.Name]; ok {
+			return env
+		}
+	}
+
+	return t.Environ[""]
+}
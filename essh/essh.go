@@ -3,6 +3,7 @@ package essh
 import (
 	"bufio"
 	"bytes"
+	"context"
 	_ "embed"
 	"fmt"
 	"io"
@@ -11,10 +12,11 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"text/template"
+	"time"
 
 	fatihColor "github.com/fatih/color"
 	"github.com/kardianos/osext"
@@ -58,6 +60,11 @@ var (
 	genFlag     bool
 	globalFlag  bool
 
+	refreshInventoryFlag bool
+	importSSHConfigFlag  bool
+	importSSHConfigVar   string
+	exportInventoryVar   string
+
 	zshCompletionModeFlag       bool
 	zshCompletionFlag           bool
 	zshCompletionHostsFlag      bool
@@ -89,12 +96,34 @@ var (
 	backendVar      string
 	prefixStringVar string
 	driverVar       string
+
+	parallelLimitVar    int
+	continueOnErrorFlag bool
+	timeoutVar          time.Duration
+	hostTimeoutVar      time.Duration
+	serialVar           string
+	outputVar           string
+	groupOutputFlag     bool
+	envVar              map[string]string
+
+	runsFlag       bool
+	runShowVar     string
+	rerunVar       string
+	failedOnlyFlag bool
+
+	dryRunFlag      bool
+	withPrepareFlag bool
+	transportVar    string
 )
 
 const (
-	ExitErr = 1
+	ExitErr        = 1
+	ExitPartialErr = 2
 )
 
+// killWaitDelay is the time to wait for the outputs of a timed out command to be closed.
+const killWaitDelay = time.Second
+
 func initResources() {
 	// Flags
 	helpFlag = false
@@ -112,6 +141,10 @@ func initResources() {
 	evalFileVar = ""
 	genFlag = false
 	globalFlag = false
+	refreshInventoryFlag = false
+	importSSHConfigFlag = false
+	importSSHConfigVar = ""
+	exportInventoryVar = ""
 	zshCompletionModeFlag = false
 	zshCompletionFlag = false
 	zshCompletionHostsFlag = false
@@ -129,6 +162,21 @@ func initResources() {
 	fileFlag = false
 	prefixFlag = false
 	parallelFlag = false
+	parallelLimitVar = 0
+	continueOnErrorFlag = false
+	timeoutVar = 0
+	hostTimeoutVar = 0
+	serialVar = ""
+	outputVar = ""
+	groupOutputFlag = false
+	envVar = map[string]string{}
+	runsFlag = false
+	runShowVar = ""
+	rerunVar = ""
+	failedOnlyFlag = false
+	dryRunFlag = false
+	withPrepareFlag = false
+	transportVar = ""
 	privilegedFlag = false
 	userVar = ""
 	ptyFlag = false
@@ -146,11 +194,13 @@ func initResources() {
 	CurrentRegistry = nil
 	GlobalRegistry = nil
 	LocalRegistry = nil
+	CurrentConfigFile = ""
 
 	// Hosts, Tasks, Drivers,
 	Hosts = map[string]*Host{}
 	Tasks = map[string]*Task{}
 	Drivers = map[string]*Driver{}
+	Inventories = map[string]*Inventory{}
 
 	// set built-in drivers
 	driver := NewDriver()
@@ -311,6 +361,7 @@ func Run(osArgs []string) (exitStatus int) {
 	}()
 
 	initResources()
+	defer nativeClients.closeAll()
 
 	if os.Getenv("ESSH_DEBUG") != "" {
 		debugFlag = true
@@ -340,6 +391,9 @@ func Run(osArgs []string) (exitStatus int) {
 			args = append(args, arg)
 		} else if arg == "--print" {
 			printFlag = true
+		} else if (arg == "--version" || arg == "--help") && len(args) > 0 && !execFlag {
+			// after a task name, these options are passed to the task. see printTaskHelp and parseTaskParams.
+			args = append(args, arg)
 		} else if arg == "--version" {
 			versionFlag = true
 		} else if arg == "--help" {
@@ -379,13 +433,34 @@ func Run(osArgs []string) (exitStatus int) {
 			selectVar = append(selectVar, osArgs[1])
 			osArgs = osArgs[1:]
 		} else if strings.HasPrefix(arg, "--select=") {
-			selectVar = append(selectVar, strings.Split(arg, "=")[1])
+			selectVar = append(selectVar, strings.SplitN(arg, "=", 2)[1])
 		} else if arg == "--tags" {
 			tagsFlag = true
 		} else if arg == "--gen" {
 			genFlag = true
 		} else if arg == "--global" {
 			globalFlag = true
+		} else if arg == "--refresh-inventory" {
+			refreshInventoryFlag = true
+		} else if arg == "--import-ssh-config" {
+			importSSHConfigFlag = true
+			// the path is optional.
+			if len(osArgs) >= 2 && !strings.HasPrefix(osArgs[1], "-") {
+				importSSHConfigVar = osArgs[1]
+				osArgs = osArgs[1:]
+			}
+		} else if strings.HasPrefix(arg, "--import-ssh-config=") {
+			importSSHConfigFlag = true
+			importSSHConfigVar = strings.SplitN(arg, "=", 2)[1]
+		} else if arg == "--export-inventory" {
+			if len(osArgs) < 2 {
+				printError("--export-inventory requires an argument.")
+				return ExitErr
+			}
+			exportInventoryVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--export-inventory=") {
+			exportInventoryVar = strings.SplitN(arg, "=", 2)[1]
 		} else if arg == "--zsh-completion" {
 			zshCompletionFlag = true
 			zshCompletionModeFlag = true
@@ -445,6 +520,147 @@ func Run(osArgs []string) (exitStatus int) {
 			userVar = strings.Split(arg, "=")[1]
 		} else if arg == "--parallel" {
 			parallelFlag = true
+		} else if arg == "--parallel-limit" {
+			if len(osArgs) < 2 {
+				printError("--parallel-limit requires an argument.")
+				return ExitErr
+			}
+			n, err := strconv.Atoi(osArgs[1])
+			if err != nil || n < 0 {
+				printError("--parallel-limit requires a positive number.")
+				return ExitErr
+			}
+			parallelLimitVar = n
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--parallel-limit=") {
+			n, err := strconv.Atoi(strings.Split(arg, "=")[1])
+			if err != nil || n < 0 {
+				printError("--parallel-limit requires a positive number.")
+				return ExitErr
+			}
+			parallelLimitVar = n
+		} else if arg == "--continue-on-error" {
+			continueOnErrorFlag = true
+		} else if arg == "--timeout" {
+			if len(osArgs) < 2 {
+				printError("--timeout requires an argument.")
+				return ExitErr
+			}
+			d, err := time.ParseDuration(osArgs[1])
+			if err != nil {
+				printError(fmt.Errorf("--timeout requires a duration like '30s': %v", err))
+				return ExitErr
+			}
+			timeoutVar = d
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--timeout=") {
+			d, err := time.ParseDuration(strings.Split(arg, "=")[1])
+			if err != nil {
+				printError(fmt.Errorf("--timeout requires a duration like '30s': %v", err))
+				return ExitErr
+			}
+			timeoutVar = d
+		} else if arg == "--host-timeout" {
+			if len(osArgs) < 2 {
+				printError("--host-timeout requires an argument.")
+				return ExitErr
+			}
+			d, err := time.ParseDuration(osArgs[1])
+			if err != nil {
+				printError(fmt.Errorf("--host-timeout requires a duration like '30s': %v", err))
+				return ExitErr
+			}
+			hostTimeoutVar = d
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--host-timeout=") {
+			d, err := time.ParseDuration(strings.Split(arg, "=")[1])
+			if err != nil {
+				printError(fmt.Errorf("--host-timeout requires a duration like '30s': %v", err))
+				return ExitErr
+			}
+			hostTimeoutVar = d
+		} else if arg == "--serial" {
+			if len(osArgs) < 2 {
+				printError("--serial requires an argument.")
+				return ExitErr
+			}
+			if _, err := parseSerial(osArgs[1], 1); err != nil {
+				printError(err)
+				return ExitErr
+			}
+			serialVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--serial=") {
+			if _, err := parseSerial(strings.Split(arg, "=")[1], 1); err != nil {
+				printError(err)
+				return ExitErr
+			}
+			serialVar = strings.Split(arg, "=")[1]
+		} else if arg == "--output" {
+			if len(osArgs) < 2 {
+				printError("--output requires an argument.")
+				return ExitErr
+			}
+			outputVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--output=") {
+			outputVar = strings.Split(arg, "=")[1]
+		} else if arg == "--env" {
+			if len(osArgs) < 2 {
+				printError("--env requires an argument.")
+				return ExitErr
+			}
+			key, value, err := parseEnvOption(osArgs[1])
+			if err != nil {
+				printError(err)
+				return ExitErr
+			}
+			envVar[key] = value
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--env=") {
+			key, value, err := parseEnvOption(strings.TrimPrefix(arg, "--env="))
+			if err != nil {
+				printError(err)
+				return ExitErr
+			}
+			envVar[key] = value
+		} else if arg == "--group-output" {
+			groupOutputFlag = true
+		} else if arg == "--runs" {
+			runsFlag = true
+		} else if arg == "--run-show" {
+			if len(osArgs) < 2 {
+				printError("--run-show requires an argument.")
+				return ExitErr
+			}
+			runShowVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--run-show=") {
+			runShowVar = strings.Split(arg, "=")[1]
+		} else if arg == "--rerun" {
+			if len(osArgs) < 2 {
+				printError("--rerun requires an argument.")
+				return ExitErr
+			}
+			rerunVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--rerun=") {
+			rerunVar = strings.Split(arg, "=")[1]
+		} else if arg == "--failed-only" {
+			failedOnlyFlag = true
+		} else if arg == "--transport" {
+			if len(osArgs) < 2 {
+				printError("--transport requires an argument.")
+				return ExitErr
+			}
+			transportVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--transport=") {
+			transportVar = strings.Split(arg, "=")[1]
+		} else if arg == "--dry-run" {
+			dryRunFlag = true
+		} else if arg == "--with-prepare" {
+			withPrepareFlag = true
 		} else if arg == "--prefix" {
 			prefixFlag = true
 		} else if arg == "--prefix-string" {
@@ -473,7 +689,7 @@ func Run(osArgs []string) (exitStatus int) {
 			targetVar = append(targetVar, osArgs[1])
 			osArgs = osArgs[1:]
 		} else if strings.HasPrefix(arg, "--target=") {
-			targetVar = append(targetVar, strings.Split(arg, "=")[1])
+			targetVar = append(targetVar, strings.SplitN(arg, "=", 2)[1])
 		} else if arg == "--filter" {
 			if len(osArgs) < 2 {
 				printError("--filter reguires an argument.")
@@ -482,7 +698,7 @@ func Run(osArgs []string) (exitStatus int) {
 			filterVar = append(filterVar, osArgs[1])
 			osArgs = osArgs[1:]
 		} else if strings.HasPrefix(arg, "--filter=") {
-			filterVar = append(filterVar, strings.Split(arg, "=")[1])
+			filterVar = append(filterVar, strings.SplitN(arg, "=", 2)[1])
 		} else if arg == "--backend" {
 			if len(osArgs) < 2 {
 				printError("--backend reguires an argument.")
@@ -510,6 +726,23 @@ func Run(osArgs []string) (exitStatus int) {
 		osArgs = osArgs[1:]
 	}
 
+	if outputVar != "" && outputVar != TASK_OUTPUT_TEXT && outputVar != TASK_OUTPUT_JSONL {
+		printError(fmt.Sprintf("--output must be '%s' or '%s'.", TASK_OUTPUT_TEXT, TASK_OUTPUT_JSONL))
+		return ExitErr
+	}
+
+	for _, selections := range [][]string{selectVar, targetVar, filterVar} {
+		if err := ValidateSelectors(selections); err != nil {
+			printError(err)
+			return ExitErr
+		}
+	}
+
+	if transportVar != "" && transportVar != TRANSPORT_SSH && transportVar != TRANSPORT_NATIVE {
+		printError(fmt.Sprintf("--transport must be '%s' or '%s'.", TRANSPORT_SSH, TRANSPORT_NATIVE))
+		return ExitErr
+	}
+
 	if colorFlag {
 		fatihColor.NoColor = false
 	}
@@ -617,6 +850,22 @@ func Run(osArgs []string) (exitStatus int) {
 		return
 	}
 
+	if importSSHConfigFlag {
+		path := importSSHConfigVar
+		if path == "" {
+			path = defaultSSHConfigFile()
+		}
+
+		hosts, err := ParseSSHConfig(path)
+		if err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		os.Stdout.Write(GenHostsLua(hosts, path))
+		return
+	}
+
 	// extend lua package path.
 	libdir := filepath.Join(UserDataDir, "lib")
 	libdir2 := filepath.Join(WorkingDataDir, "lib")
@@ -684,6 +933,7 @@ func Run(osArgs []string) (exitStatus int) {
 				fmt.Printf("[essh debug] loading config file: %s\n", WorkingDirConfigFile)
 			}
 
+			CurrentConfigFile = WorkingDirConfigFile
 			if err := L.DoFile(WorkingDirConfigFile); err != nil {
 				printError(err)
 				return ExitErr
@@ -702,6 +952,7 @@ func Run(osArgs []string) (exitStatus int) {
 				fmt.Printf("[essh debug] loading config file: %s\n", UserConfigFile)
 			}
 
+			CurrentConfigFile = UserConfigFile
 			if err := L.DoFile(UserConfigFile); err != nil {
 				printError(err)
 				return ExitErr
@@ -722,6 +973,7 @@ func Run(osArgs []string) (exitStatus int) {
 			fmt.Printf("[essh debug] loading config file: %s\n", WorkingDirOverrideConfigFile)
 		}
 
+		CurrentConfigFile = WorkingDirOverrideConfigFile
 		if err := L.DoFile(WorkingDirOverrideConfigFile); err != nil {
 			printError(err)
 			return ExitErr
@@ -741,6 +993,7 @@ func Run(osArgs []string) (exitStatus int) {
 			fmt.Printf("[essh debug] loading config file: %s\n", UserOverrideConfigFile)
 		}
 
+		CurrentConfigFile = UserOverrideConfigFile
 		if err := L.DoFile(UserOverrideConfigFile); err != nil {
 			printError(err)
 			return ExitErr
@@ -778,6 +1031,20 @@ func Run(osArgs []string) (exitStatus int) {
 		return
 	}
 
+	// show parameters of the task for completion
+	if (zshCompletionTasksFlag || bashCompletionTasksFlag) && len(args) > 0 {
+		if task := GetEnabledTask(args[0]); task != nil {
+			for _, p := range task.Params {
+				if zshCompletionTasksFlag {
+					fmt.Printf("%s\t%s\n", ColonEscape("--"+p.Name), ColonEscape(p.Description))
+				} else {
+					fmt.Printf("--%s\n", p.Name)
+				}
+			}
+		}
+		return
+	}
+
 	// show tasks for zsh completion
 	if zshCompletionTasksFlag {
 		for _, t := range NewTaskQuery().GetTasksOrderByName() {
@@ -806,6 +1073,28 @@ func Run(osArgs []string) (exitStatus int) {
 		return
 	}
 
+	// only print an inventory of the hosts
+	if exportInventoryVar != "" {
+		if len(selectVar) == 0 && len(filterVar) > 0 {
+			printError("--filter must be used with --select option.")
+			return ExitErr
+		}
+
+		query := NewHostQuery().AppendSelections(selectVar).AppendFilters(filterVar)
+		if !allFlag {
+			query = query.isVisible()
+		}
+
+		content, err := GenAnsibleInventory(query.GetHostsOrderByName(), exportInventoryVar)
+		if err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		os.Stdout.Write(content)
+		return
+	}
+
 	// only print hosts list
 	if hostsFlag {
 		if len(selectVar) == 0 && len(filterVar) > 0 {
@@ -816,6 +1105,8 @@ func Run(osArgs []string) (exitStatus int) {
 		query := NewHostQuery().AppendSelections(selectVar).AppendFilters(filterVar)
 		if !allFlag {
 			query = query.isVisible()
+		} else {
+			query = query.includePatterns().includeAbstract()
 		}
 		filteredHosts := query.GetHostsOrderByName()
 
@@ -894,6 +1185,30 @@ func Run(osArgs []string) (exitStatus int) {
 		return
 	}
 
+	// only print runs list
+	if runsFlag {
+		records, err := GetRunRecords()
+		if err != nil {
+			printError(err)
+			return ExitErr
+		}
+		printRunRecords(os.Stdout, records)
+
+		return
+	}
+
+	// only print a run
+	if runShowVar != "" {
+		rec, err := GetRunRecord(runShowVar)
+		if err != nil {
+			printError(err)
+			return ExitErr
+		}
+		printRunRecord(os.Stdout, rec)
+
+		return
+	}
+
 	// only eval lua code
 	if evalFlag {
 
@@ -970,7 +1285,7 @@ func Run(osArgs []string) (exitStatus int) {
 	}
 
 	// generate ssh hosts config
-	content, err := UpdateSSHConfig(outputConfig, NewHostQuery().GetHostsOrderByName())
+	content, err := UpdateSSHConfig(outputConfig, NewHostQuery().includePatterns().GetHostsOrderByName())
 	if err != nil {
 		printError(err)
 		return ExitErr
@@ -987,6 +1302,16 @@ func Run(osArgs []string) (exitStatus int) {
 		return
 	}
 
+	if rerunVar != "" {
+		err := rerunTask(outputConfig, rerunVar, failedOnlyFlag, L)
+		if err != nil {
+			printError(err)
+			return exitStatusFromError(err)
+		}
+
+		return
+	}
+
 	if menuFlag {
 		// Create list of items combining hosts and tasks
 		items := []list.Item{}
@@ -1059,7 +1384,7 @@ func Run(osArgs []string) (exitStatus int) {
 					err := runTask(outputConfig, task, []string{}, L)
 					if err != nil {
 						printError(err)
-						return ExitErr
+						return exitStatusFromError(err)
 					}
 				}
 			}
@@ -1081,6 +1406,7 @@ func Run(osArgs []string) (exitStatus int) {
 		task.Name = "--exec"
 		task.Pty = ptyFlag
 		task.Parallel = parallelFlag
+		task.Serial = serialVar
 		task.Privileged = privilegedFlag
 		task.User = userVar
 		task.Driver = driverVar
@@ -1114,7 +1440,7 @@ func Run(osArgs []string) (exitStatus int) {
 		err := runTask(outputConfig, task, []string{}, L)
 		if err != nil {
 			printError(err)
-			return ExitErr
+			return exitStatusFromError(err)
 		}
 
 		return
@@ -1131,10 +1457,15 @@ func Run(osArgs []string) (exitStatus int) {
 					taskargs = []string{}
 				}
 
+				if hasTaskHelpOption(taskargs) {
+					printTaskHelp(os.Stdout, task)
+					return
+				}
+
 				err := runTask(outputConfig, task, taskargs, L)
 				if err != nil {
 					printError(err)
-					return ExitErr
+					return exitStatusFromError(err)
 				}
 				return
 			}
@@ -1146,6 +1477,19 @@ func Run(osArgs []string) (exitStatus int) {
 			return
 		}
 
+		// the options that are passed after a host name are essh's.
+		for _, arg := range args[1:] {
+			if arg == "--" {
+				break
+			} else if arg == "--help" {
+				printHelp()
+				return
+			} else if arg == "--version" {
+				fmt.Printf("%s (%s)\n", Version, CommitHash)
+				return
+			}
+		}
+
 		// run ssh command
 		err, ex := runSSH(L, outputConfig, args)
 		if err != nil {
@@ -1159,6 +1503,28 @@ func Run(osArgs []string) (exitStatus int) {
 	return
 }
 
+// esshOptions are the options that Essh parses wherever they are put, so tasks can't have the parameters of the same names.
+// `--version` and `--help` aren't included, because they are passed to the task after the task name.
+var esshOptions = []string{
+	"aliases", "all", "backend", "bash-completion", "bash-completion-hosts", "bash-completion-tags", "bash-completion-tasks",
+	"color", "config", "continue-on-error", "debug", "driver", "dry-run", "env", "eval", "eval-file", "exec",
+	"export-inventory", "failed-only", "filter", "gen", "global", "group-output", "host-timeout", "hosts",
+	"import-ssh-config", "menu", "no-color", "output", "parallel", "parallel-limit", "prefix", "prefix-string", "print",
+	"privileged", "pty", "quiet", "refresh-inventory", "rerun", "run-show", "runs", "script-file", "select", "serial",
+	"ssh-config", "tags", "target", "tasks", "timeout", "transport", "user", "with-prepare", "working-dir",
+	"zsh-completion", "zsh-completion-hosts", "zsh-completion-tags", "zsh-completion-tasks",
+}
+
+func isEsshOption(name string) bool {
+	for _, option := range esshOptions {
+		if name == option {
+			return true
+		}
+	}
+
+	return false
+}
+
 func UpdateSSHConfig(outputConfig string, enabledHosts []*Host) ([]byte, error) {
 	if debugFlag {
 		fmt.Printf("[essh debug] output ssh_config contents to the file: %s \n", outputConfig)
@@ -1225,25 +1591,6 @@ func handleInput(stdinCh chan []byte, dest io.WriteCloser) {
 	}
 }
 
-// this code is borrowed from https://github.com/fujiwara/nssh/blob/master/nssh.go
-func scanLines(src io.ReadCloser, dest io.Writer, prefix string, m *sync.Mutex) {
-	scanner := bufio.NewScanner(src)
-	for scanner.Scan() {
-		// prevent mixing data in a line.
-		m.Lock()
-		if prefix != "" {
-			fmt.Fprintf(dest, "%s%s\n", color.FgCB(prefix), scanner.Text())
-		} else {
-			fmt.Fprintf(dest, "%s\n", scanner.Text())
-		}
-		m.Unlock()
-	}
-
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintf(os.Stderr, color.FgRB("essh error: scanner.Scan() returns error: %v\n", err))
-	}
-}
-
 func getHookScript(L *lua.LState, hooks []interface{}) (string, error) {
 	hookScript := ""
 	for _, hook := range hooks {
@@ -1288,7 +1635,7 @@ func convertHook(L *lua.LState, hook interface{}) (string, error) {
 	}
 }
 
-func runCommand(command string) error {
+func runCommand(timeout time.Duration, command string) error {
 	var shell, flag string
 	if runtime.GOOS == "windows" {
 		shell = "cmd"
@@ -1297,12 +1644,24 @@ func runCommand(command string) error {
 		shell = "bash"
 		flag = "-c"
 	}
-	cmd := exec.Command(shell, flag, command)
+
+	ctx, cancel := withTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, shell, flag, command)
+	if _, ok := ctx.Deadline(); ok {
+		cmd.WaitDelay = killWaitDelay
+	}
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 	cmd.Stdin = os.Stdin
 
-	return cmd.Run()
+	err := cmd.Run()
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("command timed out after %v: %v", timeout, err)
+	}
+
+	return err
 }
 
 func validateResources(tasks map[string]*Task, hosts map[string]*Host) error {
@@ -1321,6 +1680,19 @@ func validateResources(tasks map[string]*Task, hosts map[string]*Host) error {
 		}
 	}
 
+	// check dependencies of the tasks
+	for _, task := range tasks {
+		for _, name := range task.Depends {
+			if _, ok := tasks[name]; !ok {
+				return fmt.Errorf("Task '%s' depends on undefined task '%s'.", task.PublicName(), name)
+			}
+		}
+	}
+
+	if cycle := findTaskDependencyCycle(tasks); cycle != nil {
+		return fmt.Errorf("Task dependencies have a cycle: %s.", strings.Join(cycle, " -> "))
+	}
+
 	return nil
 }
 
@@ -1378,7 +1750,7 @@ func sprintByTemplate(tmplContent string) (string, error) {
 }
 
 func printError(err interface{}) {
-	fmt.Fprintf(os.Stderr, color.FgRB("essh error: %v\n", err))
+	fmt.Fprint(os.Stderr, color.FgRB("essh error: %v\n", err))
 }
 
 func init() {
@@ -0,0 +1,82 @@
+package essh
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runTestConfig runs essh with the config file in a temporary directory that doesn't read the user's config files.
+func runTestConfig(t *testing.T, config string, args ...string) (int, string) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "esshconfig.lua")
+	if err := os.WriteFile(path, []byte(strings.Replace(config, "$DIR", dir, -1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	savedDataDir, savedConfig, savedOverride := UserDataDir, UserConfigFile, UserOverrideConfigFile
+	defer func() {
+		UserDataDir, UserConfigFile, UserOverrideConfigFile = savedDataDir, savedConfig, savedOverride
+	}()
+	UserDataDir = filepath.Join(dir, "user")
+	UserConfigFile = filepath.Join(UserDataDir, "config.lua")
+	UserOverrideConfigFile = filepath.Join(UserDataDir, "config_override.lua")
+
+	return Run(append([]string{"--config", path}, args...)), dir
+}
+
+func TestRunParsesEsshOptionsAfterTaskName(t *testing.T) {
+	config := `
+task "deploy" {
+    backend = "local",
+    script = "echo \"$X:$ESSH_TASK_ARGS_1\" > $DIR/ran",
+}
+`
+	cases := []struct {
+		desc     string
+		args     []string
+		expected string
+	}{
+		{desc: "dry run after the task name", args: []string{"deploy", "--dry-run"}, expected: ""},
+		{desc: "dry run before the task name", args: []string{"--dry-run", "deploy"}, expected: ""},
+		{desc: "env after the task name", args: []string{"deploy", "--env", "X=1", "a"}, expected: "1:a\n"},
+		{desc: "env before the task name", args: []string{"--env=X=2", "deploy"}, expected: "2:\n"},
+	}
+
+	for _, c := range cases {
+		status, dir := runTestConfig(t, config, c.args...)
+		if status != 0 {
+			t.Errorf("%s: expected the exit status 0, but got %d", c.desc, status)
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(dir, "ran"))
+		if c.expected == "" {
+			if err == nil {
+				t.Errorf("%s: the task must not run, but it ran with '%s'", c.desc, b)
+			}
+			continue
+		}
+		if string(b) != c.expected {
+			t.Errorf("%s: expected the output '%s', but got '%s' (%v)", c.desc, c.expected, b, err)
+		}
+	}
+}
+
+func TestRunRejectsParamsOfEsshOptions(t *testing.T) {
+	config := `
+task "deploy" {
+    params = { { name = "env" } },
+    backend = "local",
+    script = "touch $DIR/ran",
+}
+`
+	status, dir := runTestConfig(t, config, "deploy", "--env", "X=1")
+	if status != ExitErr {
+		t.Errorf("expected the exit status %d, but got %d", ExitErr, status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ran")); err == nil {
+		t.Errorf("the task must not run")
+	}
+}
@@ -0,0 +1,400 @@
+package essh
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// FileTransfer is a file or a directory copied between the local machine and a host.
+// If Dest ends with a slash, Src is copied into the Dest directory. Otherwise, Src is copied as Dest.
+// If Src is a directory that ends with a slash, its contents are copied into Dest.
+// Src and Dest can use the host template like "logs/{{.Host.Name}}/".
+type FileTransfer struct {
+	Src  string
+	Dest string
+	// Mode is an octal string like "0644" to set to the uploaded files.
+	Mode string
+}
+
+// runWithFileTransfers uploads the task's files to the host, calls run, and downloads the task's files from the host.
+// Files are downloaded even if run failed to collect logs and so on.
+func runWithFileTransfers(ctx context.Context, sshConfigPath string, task *Task, host *Host, run func() error) error {
+	for _, t := range task.Upload {
+		if err := uploadFiles(ctx, sshConfigPath, task, host, t); err != nil {
+			return err
+		}
+	}
+
+	err := run()
+
+	for _, t := range task.Download {
+		if ctx.Err() != nil {
+			break
+		}
+		if derr := downloadFiles(ctx, sshConfigPath, task, host, t); derr != nil && err == nil {
+			err = derr
+		}
+	}
+
+	return err
+}
+
+// FileTransferError is returned when copying files failed. It has the error outputs of the remote command.
+type FileTransferError struct {
+	Op     string
+	Src    string
+	Dest   string
+	Err    error
+	Stderr string
+}
+
+func (e *FileTransferError) Error() string {
+	msg := fmt.Sprintf("couldn't %s %s to %s: %v", e.Op, e.Src, e.Dest, e.Err)
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+
+	return msg
+}
+
+func (e *FileTransferError) Unwrap() error {
+	return e.Err
+}
+
+func uploadFiles(ctx context.Context, sshConfigPath string, task *Task, host *Host, t *FileTransfer) error {
+	src, dest, err := renderFileTransfer(t, task, host)
+	if err != nil {
+		return err
+	}
+
+	var mode int64 = -1
+	if t.Mode != "" {
+		m, err := strconv.ParseUint(t.Mode, 8, 32)
+		if err != nil {
+			return err
+		}
+		mode = int64(m)
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	// decide the directory to extract the archive and the name of src in it.
+	destDir, name := dest, ""
+	if !strings.HasSuffix(dest, "/") {
+		destDir, name = path.Dir(dest), path.Base(dest)
+		if info.IsDir() {
+			destDir, name = dest, ""
+		}
+	} else if !info.IsDir() || !strings.HasSuffix(src, "/") {
+		name = filepath.Base(src)
+	}
+
+	if debugFlag {
+		fmt.Printf("[essh debug] upload %s to %s:%s\n", src, host.Name, dest)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeTarArchive(pw, src, name, mode))
+	}()
+	defer pr.Close()
+
+	command := "mkdir -p " + remoteShellPath(destDir) + " && tar -xpf - -C " + remoteShellPath(destDir)
+	if err := runFileTransferCommand(ctx, sshConfigPath, task, host, command, pr, io.Discard); err != nil {
+		err.Op, err.Src, err.Dest = "upload", src, host.Name+":"+dest
+		return err
+	}
+
+	return nil
+}
+
+func downloadFiles(ctx context.Context, sshConfigPath string, task *Task, host *Host, t *FileTransfer) error {
+	src, dest, err := renderFileTransfer(t, task, host)
+	if err != nil {
+		return err
+	}
+
+	var command string
+	rename := false
+	if strings.HasSuffix(src, "/") {
+		command = "tar -cf - -C " + remoteShellPath(src) + " ."
+	} else {
+		command = "cd " + remoteShellPath(path.Dir(src)) + " && tar -cf - " + ShellEscape(path.Base(src))
+		// src is copied as dest.
+		rename = !strings.HasSuffix(dest, "/")
+	}
+
+	destDir := dest
+	if rename {
+		destDir = filepath.Dir(dest)
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+
+	if debugFlag {
+		fmt.Printf("[essh debug] download %s:%s to %s\n", host.Name, src, dest)
+	}
+
+	pr, pw := io.Pipe()
+	extracted := make(chan error, 1)
+	go func() {
+		oldName, newName := "", ""
+		if rename {
+			oldName, newName = path.Base(src), filepath.Base(dest)
+		}
+		err := extractTarArchive(pr, destDir, oldName, newName)
+		// drain the rest to finish the remote command.
+		io.Copy(io.Discard, pr)
+		extracted <- err
+	}()
+
+	terr := runFileTransferCommand(ctx, sshConfigPath, task, host, command, nil, pw)
+	pw.Close()
+	err = <-extracted
+	if terr != nil {
+		terr.Op, terr.Src, terr.Dest = "download", host.Name+":"+src, dest
+		return terr
+	}
+
+	return err
+}
+
+func renderFileTransfer(t *FileTransfer, task *Task, host *Host) (string, string, error) {
+	src, err := renderHostTemplate(t.Src, task, host)
+	if err != nil {
+		return "", "", err
+	}
+
+	dest, err := renderHostTemplate(t.Dest, task, host)
+	if err != nil {
+		return "", "", err
+	}
+
+	return src, dest, nil
+}
+
+// renderHostTemplate renders the text template with the host and the task like the prefix.
+func renderHostTemplate(text string, task *Task, host *Host) (string, error) {
+	funcMap := template.FuncMap{
+		"ShellEscape":  ShellEscape,
+		"ToUpper":      strings.ToUpper,
+		"ToLower":      strings.ToLower,
+		"EnvKeyEscape": EnvKeyEscape,
+	}
+
+	dict := map[string]interface{}{
+		"Host": host,
+		"Task": task,
+	}
+
+	tmpl, err := template.New("T").Funcs(funcMap).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, dict); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// remoteShellPath quotes the path for the remote shell keeping "~/" expanded to the home directory.
+func remoteShellPath(p string) string {
+	if p == "~" {
+		return `"$HOME"`
+	} else if strings.HasPrefix(p, "~/") {
+		return `"$HOME"/` + ShellEscape(p[2:])
+	}
+
+	return ShellEscape(p)
+}
+
+// runFileTransferCommand runs the command on the host by the task's transport.
+func runFileTransferCommand(ctx context.Context, sshConfigPath string, task *Task, host *Host, command string, stdin io.Reader, stdout io.Writer) *FileTransferError {
+	stderr := &bytes.Buffer{}
+
+	var err error
+	if taskTransport(task, host) == TRANSPORT_NATIVE {
+		if err = checkNativeTask(task); err == nil {
+			err = runNativeCommand(ctx, host, command, stdin, stdout, stderr)
+		}
+	} else {
+		args := append([]string{}, task.SSHOptions...)
+		args = append(args, "-F", sshConfigPath, host.Name, command)
+		cmd := exec.CommandContext(ctx, "ssh", args...)
+		if _, ok := ctx.Deadline(); ok {
+			cmd.WaitDelay = killWaitDelay
+		}
+		cmd.Stdin = stdin
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		err = cmd.Run()
+	}
+
+	if err != nil {
+		return &FileTransferError{Err: err, Stderr: strings.TrimSpace(stderr.String())}
+	}
+
+	return nil
+}
+
+// writeTarArchive writes src to the archive as name. If name is empty, the contents of the src directory are written.
+// mode is set to the regular files if it is not negative.
+func writeTarArchive(w io.Writer, src string, name string, mode int64) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		entryName := path.Join(name, filepath.ToSlash(rel))
+		if entryName == "" || entryName == "." {
+			// the root of the contents is the destination directory itself.
+			return nil
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = entryName
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+		if info.IsDir() {
+			header.Name += "/"
+		} else if info.Mode().IsRegular() && mode >= 0 {
+			header.Mode = mode
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			if _, err := io.Copy(tw, f); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// extractTarArchive extracts the regular files and the directories in the archive to the dir.
+// The entry of oldName is renamed to newName. Entries that point outside of the dir or through a symlink are refused.
+// Symlinks and other special files in the archive are skipped.
+func extractTarArchive(r io.Reader, dir string, oldName string, newName string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name := path.Clean(header.Name)
+		if oldName != "" {
+			if name == oldName {
+				name = newName
+			} else if strings.HasPrefix(name, oldName+"/") {
+				name = newName + name[len(oldName):]
+			}
+		}
+
+		if name == "." {
+			continue
+		}
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("invalid path '%s' in the archive", header.Name)
+		}
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := checkExtractPath(dir, name); err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(file, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			if debugFlag {
+				fmt.Printf("[essh debug] skip '%s' in the archive that is not a regular file or a directory\n", header.Name)
+			}
+		}
+	}
+}
+
+// checkExtractPath returns an error if the dir has a symlink in the path of the entry,
+// because writing the entry through the symlink may overwrite a file outside of the dir.
+func checkExtractPath(dir string, name string) error {
+	file := dir
+	for _, elem := range strings.Split(name, "/") {
+		file = filepath.Join(file, elem)
+		info, err := os.Lstat(file)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("invalid path '%s' in the archive: '%s' is a symlink", name, file)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package essh
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testTarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+}
+
+func newTestTarArchive(t *testing.T, entries []testTarEntry) *bytes.Buffer {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, e := range entries {
+		header := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Mode:     0644,
+			Size:     int64(len(e.body)),
+			Linkname: e.linkname,
+		}
+		if e.typeflag != tar.TypeReg {
+			header.Size = 0
+			header.Mode = 0755
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if e.typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &b
+}
+
+func TestExtractTarArchive(t *testing.T) {
+	dir := t.TempDir()
+	archive := newTestTarArchive(t, []testTarEntry{
+		{name: "./", typeflag: tar.TypeDir},
+		{name: "app/", typeflag: tar.TypeDir},
+		{name: "app/config.txt", typeflag: tar.TypeReg, body: "config"},
+		{name: "app/link", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"},
+	})
+
+	if err := extractTarArchive(archive, dir, "app", "renamed"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "renamed", "config.txt"))
+	if err != nil {
+		t.Fatalf("the renamed file is not extracted: %v", err)
+	}
+	if string(b) != "config" {
+		t.Errorf("expected 'config', but got '%s'", b)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "renamed", "link")); !os.IsNotExist(err) {
+		t.Errorf("the symlink in the archive must be skipped: %v", err)
+	}
+}
+
+func TestExtractTarArchiveRefusesInvalidPaths(t *testing.T) {
+	cases := []struct {
+		desc    string
+		entries []testTarEntry
+	}{
+		{
+			desc:    "parent directory",
+			entries: []testTarEntry{{name: "../escaped.txt", typeflag: tar.TypeReg, body: "x"}},
+		},
+		{
+			desc:    "parent directory in the middle",
+			entries: []testTarEntry{{name: "a/../../escaped.txt", typeflag: tar.TypeReg, body: "x"}},
+		},
+		{
+			desc:    "parent directory itself",
+			entries: []testTarEntry{{name: "..", typeflag: tar.TypeDir}},
+		},
+		{
+			desc:    "absolute path",
+			entries: []testTarEntry{{name: "/tmp/escaped.txt", typeflag: tar.TypeReg, body: "x"}},
+		},
+	}
+
+	for _, c := range cases {
+		parent := t.TempDir()
+		dir := filepath.Join(parent, "dest")
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		err := extractTarArchive(newTestTarArchive(t, c.entries), dir, "", "")
+		if err == nil || !strings.Contains(err.Error(), "invalid path") {
+			t.Errorf("%s: expected an invalid path error, but got %v", c.desc, err)
+		}
+		if _, err := os.Stat(filepath.Join(parent, "escaped.txt")); !os.IsNotExist(err) {
+			t.Errorf("%s: a file is written outside of the destination", c.desc)
+		}
+	}
+}
+
+func TestExtractTarArchiveRefusesSymlinksInDestination(t *testing.T) {
+	outside := t.TempDir()
+	dir := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "file.txt"), []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "file.txt"), filepath.Join(dir, "file-link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		desc    string
+		entries []testTarEntry
+	}{
+		{
+			desc:    "file in a symlinked directory",
+			entries: []testTarEntry{{name: "link/escaped.txt", typeflag: tar.TypeReg, body: "x"}},
+		},
+		{
+			desc:    "directory in a symlinked directory",
+			entries: []testTarEntry{{name: "link/escaped/", typeflag: tar.TypeDir}},
+		},
+		{
+			desc:    "symlinked file",
+			entries: []testTarEntry{{name: "file-link.txt", typeflag: tar.TypeReg, body: "overwritten"}},
+		},
+	}
+
+	for _, c := range cases {
+		err := extractTarArchive(newTestTarArchive(t, c.entries), dir, "", "")
+		if err == nil || !strings.Contains(err.Error(), "symlink") {
+			t.Errorf("%s: expected a symlink error, but got %v", c.desc, err)
+		}
+	}
+
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("files are written outside of the destination: %v", entries)
+	}
+	if b, _ := os.ReadFile(filepath.Join(outside, "file.txt")); string(b) != "original" {
+		t.Errorf("the file outside of the destination is overwritten: %s", b)
+	}
+}
@@ -0,0 +1,462 @@
+package essh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sevir/essh/support/color"
+	"github.com/sevir/essh/support/helper"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// maxRunRecords is the number of runs kept in a runs directory. Older runs are removed.
+const maxRunRecords = 100
+
+// RunRecord is a record of a task run saved in the run history.
+type RunRecord struct {
+	ID      string   `json:"id"`
+	Task    string   `json:"task"`
+	Args    []string `json:"args"`
+	Backend string   `json:"backend"`
+	Targets []string `json:"targets"`
+	Filters []string `json:"filters"`
+	// Exec has the options of the task created by --exec to run it again.
+	Exec *RunExecOptions `json:"exec,omitempty"`
+	// Step is the name of the task's step if the run is a step of the task.
+	Step string `json:"step,omitempty"`
+	// RerunOf is the id of the original run if the run is created by --rerun.
+	RerunOf    string           `json:"rerun_of,omitempty"`
+	StartedAt  time.Time        `json:"started_at"`
+	FinishedAt time.Time        `json:"finished_at"`
+	Error      string           `json:"error,omitempty"`
+	Hosts      []*RunHostRecord `json:"hosts"`
+
+	registry *Registry
+}
+
+type RunExecOptions struct {
+	Script     []map[string]string `json:"script"`
+	File       string              `json:"file,omitempty"`
+	Driver     string              `json:"driver,omitempty"`
+	Pty        bool                `json:"pty"`
+	Parallel   bool                `json:"parallel"`
+	Serial     string              `json:"serial,omitempty"`
+	Privileged bool                `json:"privileged"`
+	User       string              `json:"user,omitempty"`
+	UsePrefix  bool                `json:"use_prefix"`
+	Prefix     string              `json:"prefix,omitempty"`
+}
+
+type RunHostRecord struct {
+	Host     string  `json:"host"`
+	Status   string  `json:"status"`
+	ExitCode int     `json:"exit_code"`
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+	Script   string  `json:"script,omitempty"`
+	Stdout   string  `json:"stdout"`
+	Stderr   string  `json:"stderr"`
+}
+
+// usesLocalRuns returns true if the runs are recorded in the working directory.
+// Runs of the tasks that are not defined in config files like --exec are recorded there if the working directory has a config file.
+func usesLocalRuns() bool {
+	_, err := os.Stat(WorkingDirConfigFile)
+	return err == nil && !globalFlag
+}
+
+func newRunRecord(task *Task) *RunRecord {
+	registry := task.Registry
+	if registry == nil {
+		if usesLocalRuns() {
+			registry = LocalRegistry
+		} else {
+			registry = GlobalRegistry
+		}
+	}
+
+	name := task.Name
+	if task.StepOf != nil {
+		name = task.StepOf.Name
+	}
+
+	rec := &RunRecord{
+		Task:      name,
+		Step:      task.StepName(),
+		Args:      task.RawArgs,
+		Backend:   task.Backend,
+		Targets:   task.Targets,
+		Filters:   task.Filters,
+		RerunOf:   rerunVar,
+		StartedAt: time.Now(),
+		Hosts:     []*RunHostRecord{},
+		registry:  registry,
+	}
+
+	if task.Name == "--exec" {
+		rec.Exec = &RunExecOptions{
+			Script:     task.Script,
+			File:       task.File,
+			Driver:     task.Driver,
+			Pty:        task.Pty,
+			Parallel:   task.Parallel,
+			Serial:     task.Serial,
+			Privileged: task.Privileged,
+			User:       task.User,
+			UsePrefix:  task.UsePrefix,
+			Prefix:     task.Prefix,
+		}
+	}
+
+	return rec
+}
+
+func (rec *RunRecord) finish(results []*HostResult, err error) {
+	rec.FinishedAt = time.Now()
+	if err != nil {
+		rec.Error = err.Error()
+	}
+
+	for _, r := range results {
+		h := &RunHostRecord{
+			Host:     r.HostName(),
+			Status:   r.Status(),
+			ExitCode: r.ExitCode,
+			Duration: r.Duration.Seconds(),
+			Script:   r.Script,
+			Stdout:   string(r.Stdout),
+			Stderr:   string(r.Stderr),
+		}
+		if r.Err != nil {
+			h.Error = r.Err.Error()
+		}
+		rec.Hosts = append(rec.Hosts, h)
+	}
+}
+
+func (rec *RunRecord) Status() string {
+	if rec.Error != "" {
+		return "failed"
+	}
+
+	return "ok"
+}
+
+// TaskName returns the name of the task including the step's name.
+func (rec *RunRecord) TaskName() string {
+	if rec.Step != "" {
+		return rec.Task + "/" + rec.Step
+	}
+
+	return rec.Task
+}
+
+// FailedHosts returns the hosts that failed or timed out. The hosts that didn't run because they were aborted or skipped aren't included.
+func (rec *RunRecord) FailedHosts() []*RunHostRecord {
+	failed := []*RunHostRecord{}
+	for _, h := range rec.Hosts {
+		if h.Status == "failed" || h.Status == "timed out" {
+			failed = append(failed, h)
+		}
+	}
+
+	return failed
+}
+
+func (rec *RunRecord) newTask() (*Task, error) {
+	if rec.Exec == nil {
+		task := GetEnabledTask(rec.Task)
+		if task == nil {
+			return nil, fmt.Errorf("task '%s' of the run '%s' is not defined or disabled.", rec.Task, rec.ID)
+		}
+
+		return task, nil
+	}
+
+	task := NewTask()
+	task.Name = rec.Task
+	task.Backend = rec.Backend
+	task.Targets = rec.Targets
+	task.Filters = rec.Filters
+	task.Script = rec.Exec.Script
+	task.File = rec.Exec.File
+	task.Driver = rec.Exec.Driver
+	task.Pty = rec.Exec.Pty
+	task.Parallel = rec.Exec.Parallel
+	task.Serial = rec.Exec.Serial
+	task.Privileged = rec.Exec.Privileged
+	task.User = rec.Exec.User
+	task.UsePrefix = rec.Exec.UsePrefix
+	task.Prefix = rec.Exec.Prefix
+
+	return task, nil
+}
+
+// saveRunRecord writes the record to the runs directory of the task's registry and removes old records.
+func saveRunRecord(rec *RunRecord) error {
+	dir := rec.registry.RunsDir()
+	if err := os.MkdirAll(dir, os.FileMode(0700)); err != nil {
+		return err
+	}
+
+	// the id is made of the start time and a random suffix to avoid conflicts between concurrent runs.
+	var f *os.File
+	for {
+		rec.ID = fmt.Sprintf("%s-%04x", rec.StartedAt.Format("20060102-150405"), rand.Intn(0x10000))
+		var err error
+		f, err = os.OpenFile(filepath.Join(dir, rec.ID+".json"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			break
+		} else if !os.IsExist(err) {
+			return err
+		}
+	}
+	defer f.Close()
+
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+
+	if debugFlag {
+		fmt.Printf("[essh debug] saved the run '%s' to %s\n", rec.ID, dir)
+	}
+
+	return pruneRunRecords(dir)
+}
+
+func pruneRunRecords(dir string) error {
+	files, err := runRecordFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	for len(files) > maxRunRecords {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+
+	return nil
+}
+
+// runRecordFiles returns paths of the records in the dir ordered by the ids, that means the oldest is first.
+func runRecordFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+func loadRunRecord(path string) (*RunRecord, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &RunRecord{}
+	if err := json.Unmarshal(b, rec); err != nil {
+		return nil, fmt.Errorf("couldn't load the run %s: %v", path, err)
+	}
+
+	return rec, nil
+}
+
+// runsDirs returns the runs directories to look up the runs.
+// The global registry's one is included in the local context, because global tasks are recorded there.
+func runsDirs() []string {
+	dirs := []string{}
+	if usesLocalRuns() && LocalRegistry.DataDir != GlobalRegistry.DataDir {
+		dirs = append(dirs, LocalRegistry.RunsDir())
+	}
+
+	return append(dirs, GlobalRegistry.RunsDir())
+}
+
+func GetRunRecords() ([]*RunRecord, error) {
+	records := []*RunRecord{}
+	for _, dir := range runsDirs() {
+		files, err := runRecordFiles(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			rec, err := loadRunRecord(file)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, rec)
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].StartedAt.Before(records[j].StartedAt)
+	})
+
+	return records, nil
+}
+
+func GetRunRecord(id string) (*RunRecord, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) {
+		return nil, fmt.Errorf("invalid run id '%s'.", id)
+	}
+
+	for _, dir := range runsDirs() {
+		path := filepath.Join(dir, id+".json")
+		if _, err := os.Stat(path); err == nil {
+			return loadRunRecord(path)
+		}
+	}
+
+	return nil, fmt.Errorf("run '%s' is not found.", id)
+}
+
+func printRunRecords(w io.Writer, records []*RunRecord) {
+	tb := helper.NewPlainTable(w)
+	if !quietFlag {
+		tb.SetHeader([]string{"ID", "TASK", "STARTED", "DURATION", "HOSTS", "FAILED", "STATUS"})
+	}
+	for _, rec := range records {
+		if quietFlag {
+			tb.Append([]string{rec.ID})
+		} else {
+			tb.Append([]string{
+				rec.ID,
+				rec.TaskName(),
+				rec.StartedAt.Format("2006-01-02 15:04:05"),
+				rec.FinishedAt.Sub(rec.StartedAt).Round(time.Millisecond).String(),
+				strconv.Itoa(len(rec.Hosts)),
+				strconv.Itoa(len(rec.FailedHosts())),
+				rec.Status(),
+			})
+		}
+	}
+	tb.Render()
+}
+
+func printRunRecord(w io.Writer, rec *RunRecord) {
+	fmt.Fprintf(w, "ID:        %s\n", rec.ID)
+	fmt.Fprintf(w, "Task:      %s\n", rec.Task)
+	if rec.Step != "" {
+		fmt.Fprintf(w, "Step:      %s\n", rec.Step)
+	}
+	fmt.Fprintf(w, "Args:      %s\n", strings.Join(rec.Args, " "))
+	fmt.Fprintf(w, "Backend:   %s\n", rec.Backend)
+	fmt.Fprintf(w, "Targets:   %s\n", strings.Join(rec.Targets, ", "))
+	fmt.Fprintf(w, "Filters:   %s\n", strings.Join(rec.Filters, ", "))
+	if rec.RerunOf != "" {
+		fmt.Fprintf(w, "Rerun of:  %s\n", rec.RerunOf)
+	}
+	fmt.Fprintf(w, "Started:   %s\n", rec.StartedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "Finished:  %s\n", rec.FinishedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "Status:    %s\n", rec.Status())
+	if rec.Error != "" {
+		fmt.Fprintf(w, "Error:     %s\n", rec.Error)
+	}
+
+	for _, h := range rec.Hosts {
+		fmt.Fprintln(w)
+		fmt.Fprint(w, color.FgCB("=== %s (%s, exit %d, %s) ===\n", h.Host, h.Status, h.ExitCode, time.Duration(h.Duration*float64(time.Second)).Round(time.Millisecond)))
+		if h.Error != "" {
+			fmt.Fprintf(w, "error: %s\n", h.Error)
+		}
+		printTextSection(w, "script", h.Script)
+		printTextSection(w, "stdout", h.Stdout)
+		printTextSection(w, "stderr", h.Stderr)
+	}
+}
+
+func printTextSection(w io.Writer, name string, content string) {
+	if content == "" {
+		return
+	}
+
+	fmt.Fprint(w, color.FgYB("--- %s ---\n", name))
+	fmt.Fprint(w, content)
+	if !strings.HasSuffix(content, "\n") {
+		fmt.Fprintln(w)
+	}
+}
+
+// rerunTask runs the task of the recorded run again against the same hosts, or only the hosts that failed.
+// If the run is a step of the task, only the step runs again. It doesn't run the task's dependencies.
+func rerunTask(config string, id string, failedOnly bool, L *lua.LState) error {
+	rec, err := GetRunRecord(id)
+	if err != nil {
+		return err
+	}
+
+	task, err := rec.newTask()
+	if err != nil {
+		return err
+	}
+
+	hosts := rec.Hosts
+	if failedOnly {
+		if len(rec.Targets) == 0 {
+			return fmt.Errorf("run '%s' doesn't have target hosts. --failed-only can't be used.", rec.ID)
+		}
+		hosts = rec.FailedHosts()
+		if len(hosts) == 0 {
+			return fmt.Errorf("run '%s' doesn't have failed hosts.", rec.ID)
+		}
+	}
+
+	if err := prepareTask(task, rec.Args, L); err != nil {
+		return err
+	}
+
+	if rec.Step != "" {
+		step := task.Step(rec.Step)
+		if step == nil {
+			return fmt.Errorf("task '%s' of the run '%s' doesn't have the step '%s'.", rec.Task, rec.ID, rec.Step)
+		}
+		task = newStepTask(task, step)
+
+		if err := resolveTaskTargets(task, L); err != nil {
+			return err
+		}
+		if err := prepareTaskHosts(task, L); err != nil {
+			return err
+		}
+	}
+
+	if len(rec.Targets) > 0 {
+		// run on the recorded hosts instead of selecting hosts again.
+		targets := []string{}
+		for _, h := range hosts {
+			targets = append(targets, h.Host)
+		}
+		task.Targets = targets
+		task.TargetHosts = nil
+		task.Filters = []string{}
+
+		if err := prepareTaskHosts(task, L); err != nil {
+			return err
+		}
+	}
+
+	if err := prepareTaskContents(config, task); err != nil {
+		return err
+	}
+
+	results, err := runTaskScripts(config, task, true)
+	return finishTask(task, results, err)
+}
@@ -7,6 +7,7 @@ import (
 	"sort"
 	"strings"
 	"text/template"
+	"time"
 	"unicode"
 )
 
@@ -14,12 +15,19 @@ type Host struct {
 	Name                 string
 	Description          string
 	Props                map[string]string
+	Env                  map[string]interface{}
 	HooksBeforeConnect   []interface{}
 	HooksAfterConnect    []interface{}
 	HooksAfterDisconnect []interface{}
+	HooksTimeout         time.Duration
+	Transport            string
 	Hidden               bool
+	Abstract             bool
 	Tags                 []string
 	SSHConfig            map[string]string
+	SSHConfigValues      map[string][]string
+	Aliases              []string
+	Extends              []string
 	Registry             *Registry
 	Group                *Group
 	LValues              map[string]lua.LValue
@@ -33,11 +41,13 @@ var Hosts map[string]*Host
 func NewHost() *Host {
 	return &Host{
 		Props:                map[string]string{},
+		Env:                  map[string]interface{}{},
 		HooksBeforeConnect:   []interface{}{},
 		HooksAfterConnect:    []interface{}{},
 		HooksAfterDisconnect: []interface{}{},
 		Tags:                 []string{},
 		SSHConfig:            map[string]string{},
+		SSHConfigValues:      map[string][]string{},
 		LValues:              map[string]lua.LValue{},
 	}
 }
@@ -68,6 +78,133 @@ func (h *Host) SortedSSHConfig() []map[string]string {
 	return values
 }
 
+// SSHConfigLines returns the ssh_config lines sorted by the keys. The properties that have multiple values are repeated.
+func (h *Host) SSHConfigLines() []map[string]string {
+	lines := []map[string]string{}
+	for _, param := range h.SortedSSHConfig() {
+		for name, v := range param {
+			values, ok := h.SSHConfigValues[name]
+			if !ok {
+				values = []string{v}
+			}
+			for _, value := range values {
+				lines = append(lines, map[string]string{name: value})
+			}
+		}
+	}
+
+	return lines
+}
+
+// IsPattern returns true if the host's name is a pattern like `*.internal` that defines defaults of the matched hosts in ssh_config.
+func (h *Host) IsPattern() bool {
+	return strings.ContainsAny(h.Name, "*?")
+}
+
+// SSHConfigPatterns returns the name and the aliases for the `Host` line of ssh_config.
+func (h *Host) SSHConfigPatterns() string {
+	return strings.Join(append([]string{h.Name}, h.Aliases...), " ")
+}
+
+// matchSSHName returns true if ssh applies the host's config to the name.
+func (h *Host) matchSSHName(name string) bool {
+	return matchSSHConfigPatterns(append([]string{h.Name}, h.Aliases...), name)
+}
+
+// FindHost returns the host that has the name or the alias. Abstract hosts aren't found, because they aren't real hosts.
+func FindHost(name string) *Host {
+	if host := Hosts[name]; host != nil && !host.Abstract {
+		return host
+	}
+
+	for _, host := range Hosts {
+		if host.Abstract {
+			continue
+		}
+		for _, alias := range host.Aliases {
+			if alias == name {
+				return host
+			}
+		}
+	}
+
+	return nil
+}
+
+// effectiveSSHConfig returns the ssh config for the name merged with the pattern hosts that match it like ssh does.
+func effectiveSSHConfig(name string) map[string]string {
+	hosts := []*Host{}
+	for _, host := range Hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Sort(NameSortableHosts(hosts))
+
+	config := map[string]string{}
+	for _, host := range sortHostsForSSHConfig(hosts) {
+		if host.Abstract || !host.matchSSHName(name) {
+			continue
+		}
+		for key, value := range host.SSHConfig {
+			if sshConfigValue(config, key) == "" {
+				config[key] = value
+			}
+		}
+	}
+
+	return config
+}
+
+// effectiveSSHConfigValues returns all the values of the key for the name.
+// The values of the matched hosts are accumulated like ssh does for the keys like IdentityFile.
+func effectiveSSHConfigValues(name string, key string) []string {
+	hosts := []*Host{}
+	for _, host := range Hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Sort(NameSortableHosts(hosts))
+
+	values := []string{}
+	for _, host := range sortHostsForSSHConfig(hosts) {
+		if host.Abstract || !host.matchSSHName(name) {
+			continue
+		}
+		for k, v := range host.SSHConfig {
+			if !strings.EqualFold(k, key) {
+				continue
+			}
+			if vs, ok := host.SSHConfigValues[k]; ok {
+				values = append(values, vs...)
+			} else {
+				values = append(values, v)
+			}
+		}
+	}
+
+	return values
+}
+
+// sortHostsForSSHConfig orders the hosts so that the specific hosts precede the pattern hosts, because ssh uses the first obtained value.
+// Pattern hosts that have longer literal parts come first, so `*.prod.internal` precedes `*.internal` and `*` is the last.
+func sortHostsForSSHConfig(hosts []*Host) []*Host {
+	literalLen := func(h *Host) int {
+		return len(h.Name) - strings.Count(h.Name, "*") - strings.Count(h.Name, "?")
+	}
+
+	sorted := append([]*Host{}, hosts...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		pi, pj := sorted[i].IsPattern(), sorted[j].IsPattern()
+		if pi != pj {
+			return !pi
+		}
+		if pi {
+			return literalLen(sorted[i]) > literalLen(sorted[j])
+		}
+		return false
+	})
+
+	return sorted
+}
+
 func (h *Host) DescriptionOrDefault() string {
 	if h.Description == "" {
 		return h.Name + " host"
@@ -77,7 +214,7 @@ func (h *Host) DescriptionOrDefault() string {
 }
 
 var hostsTemplate = `{{range $i, $host := .Hosts -}}
-Host {{$host.Name}}{{range $ii, $param := $host.SortedSSHConfig}}{{range $k, $v := $param}}
+Host {{$host.SSHConfigPatterns}}{{range $ii, $param := $host.SSHConfigLines}}{{range $k, $v := $param}}
     {{$k}} {{$v}}{{end}}{{end}}
 
 {{end -}}`
@@ -88,7 +225,15 @@ func GenHostsConfig(enabledHosts []*Host) ([]byte, error) {
 		return nil, err
 	}
 
-	input := map[string]interface{}{"Hosts": enabledHosts}
+	// abstract hosts are only the bases of other hosts, so they aren't written to ssh_config.
+	hosts := []*Host{}
+	for _, host := range enabledHosts {
+		if !host.Abstract {
+			hosts = append(hosts, host)
+		}
+	}
+
+	input := map[string]interface{}{"Hosts": sortHostsForSSHConfig(hosts)}
 	var b bytes.Buffer
 	if err := tmpl.Execute(&b, input); err != nil {
 		return nil, err
@@ -199,10 +344,68 @@ func registerHost(L *lua.LState, name string) *Host {
 
 func setupHost(L *lua.LState, h *Host, config *lua.LTable) {
 	config.ForEach(func(k, v lua.LValue) {
-		if kstr, ok := toString(k); ok {
+		if kstr, ok := toString(k); ok && kstr != "extends" {
 			updateHost(L, h, kstr, v)
 		}
 	})
+
+	// extends is evaluated at last to merge the base hosts into the values of the host.
+	if v := config.RawGetString("extends"); v != lua.LNil {
+		updateHost(L, h, "extends", v)
+	}
+}
+
+// extendHost merges the config of the base host into the host. The host's own values win.
+// Tags, props and env are merged, and the base host's hooks run before the host's hooks.
+func extendHost(L *lua.LState, h *Host, base *Host) {
+	keys := []string{}
+	for key := range base.LValues {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := base.LValues[key]
+		switch key {
+		case "extends", "hidden", "abstract", "aliases":
+			// the base hosts are usually abstract, but the hosts that extend them are not.
+			// aliases are names of the base host, so they aren't inherited either.
+		case "props", "env":
+			merged := L.NewTable()
+			for _, v := range []lua.LValue{value, h.LValues[key]} {
+				if tb, ok := toLTable(v); ok {
+					tb.ForEach(func(k lua.LValue, v lua.LValue) {
+						merged.RawSet(k, v)
+					})
+				}
+			}
+			updateHost(L, h, key, merged)
+		case "tags":
+			tags := L.NewTable()
+			exists := map[string]bool{}
+			for _, tag := range append(append([]string{}, h.Tags...), base.Tags...) {
+				if !exists[tag] {
+					exists[tag] = true
+					tags.Append(lua.LString(tag))
+				}
+			}
+			updateHost(L, h, key, tags)
+		case "hooks_before_connect", "hooks_after_connect", "hooks_after_disconnect":
+			hooks := L.NewTable()
+			for _, v := range []lua.LValue{value, h.LValues[key]} {
+				if tb, ok := toLTable(v); ok {
+					for i := 1; i <= tb.MaxN(); i++ {
+						hooks.Append(tb.RawGetInt(i))
+					}
+				}
+			}
+			updateHost(L, h, key, hooks)
+		default:
+			if h.LValues[key] == nil {
+				updateHost(L, h, key, value)
+			}
+		}
+	}
 }
 
 func updateHost(L *lua.LState, h *Host, key string, value lua.LValue) {
@@ -217,13 +420,75 @@ func updateHost(L *lua.LState, h *Host, key string, value lua.LValue) {
 	if unicode.IsUpper(firstChar) {
 		if valuestr, ok := toString(value); ok {
 			h.SSHConfig[key] = valuestr
+			delete(h.SSHConfigValues, key)
 			return
 		}
 
-		panic("SSH property must be string")
+		// a table sets multiple values like `IdentityFile = {"~/.ssh/a", "~/.ssh/b"}`. The other functions use the first value.
+		if tb, ok := toLTable(value); ok && tb.MaxN() > 0 {
+			values := []string{}
+			for i := 1; i <= tb.MaxN(); i++ {
+				valuestr, ok := toString(tb.RawGetInt(i))
+				if !ok {
+					panic("SSH property must be string or a table of strings")
+				}
+				values = append(values, valuestr)
+			}
+			h.SSHConfig[key] = values[0]
+			h.SSHConfigValues[key] = values
+			return
+		}
+
+		panic("SSH property must be string or a table of strings")
 	}
 
 	switch key {
+	case "extends":
+		var extends []string
+		if extendsStr, ok := toString(value); ok {
+			extends = []string{extendsStr}
+		} else if extendsSlice, ok := toSlice(value); ok {
+			for _, name := range extendsSlice {
+				if nameStr, ok := name.(string); ok {
+					extends = append(extends, nameStr)
+				}
+			}
+		} else {
+			panic("invalid value of a host's field '" + key + "'.")
+		}
+
+		// the later base hosts override the former ones.
+		for i := len(extends) - 1; i >= 0; i-- {
+			base := Hosts[extends[i]]
+			if base == nil {
+				L.RaiseError("host '%s' extends the undefined host '%s'. the base host must be defined before.", h.Name, extends[i])
+			}
+			if base == h {
+				L.RaiseError("host '%s' can't extend itself.", h.Name)
+			}
+			extendHost(L, h, base)
+		}
+		h.Extends = extends
+	case "aliases":
+		if aliasStr, ok := toString(value); ok {
+			h.Aliases = []string{aliasStr}
+		} else if aliasesSlice, ok := toSlice(value); ok {
+			h.Aliases = []string{}
+			for _, alias := range aliasesSlice {
+				if aliasStr, ok := alias.(string); ok {
+					h.Aliases = append(h.Aliases, aliasStr)
+				}
+			}
+		} else {
+			panic("invalid value of a host's field '" + key + "'.")
+		}
+		for _, alias := range h.Aliases {
+			if alias == "" || strings.ContainsAny(alias, " \t") {
+				L.RaiseError("host '%s' has an invalid alias '%s'.", h.Name, alias)
+			}
+		}
+	case "env":
+		h.Env = toEnv(L, value)
 	case "props":
 		if propsTb, ok := toLTable(value); ok {
 			// initialize
@@ -280,6 +545,21 @@ func updateHost(L *lua.LState, h *Host, key string, value lua.LValue) {
 		} else {
 			panic("invalid value of a host's field '" + key + "'.")
 		}
+	case "hooks_timeout":
+		if timeout, ok := toDuration(value); ok {
+			h.HooksTimeout = timeout
+		} else {
+			panic("invalid value of a host's field '" + key + "'.")
+		}
+	case "transport":
+		if transportStr, ok := toString(value); ok {
+			h.Transport = transportStr
+			if transportStr != TRANSPORT_SSH && transportStr != TRANSPORT_NATIVE {
+				L.RaiseError("transport must be '%s' or '%s'.", TRANSPORT_SSH, TRANSPORT_NATIVE)
+			}
+		} else {
+			panic("invalid value of a host's field '" + key + "'.")
+		}
 	case "description":
 		if descStr, ok := toString(value); ok {
 			h.Description = descStr
@@ -294,6 +574,13 @@ func updateHost(L *lua.LState, h *Host, key string, value lua.LValue) {
 			panic("invalid value of a host's field '" + key + "'.")
 		}
 
+	case "abstract":
+		if abstractBool, ok := toBool(value); ok {
+			h.Abstract = abstractBool
+		} else {
+			panic("invalid value of a host's field '" + key + "'.")
+		}
+
 	case "tags":
 		if tagsTb, ok := toLTable(value); ok {
 			// initialize
@@ -1,8 +1,11 @@
 package essh
 
 import (
-	"github.com/yuin/gopher-lua"
 	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
 )
 
 type HostQuery struct {
@@ -10,6 +13,15 @@ type HostQuery struct {
 	Selections []string
 	Filters    []string
 	Hidden     *bool
+	// Patterns includes the pattern hosts like `*.internal` that aren't real hosts.
+	Patterns bool
+	// Abstract includes the abstract hosts that are only the bases of other hosts.
+	Abstract bool
+	// Predicates, Exclusions, SortKey and Limit are applied in this order after the selections and the filters.
+	Predicates []func(host *Host) bool
+	Exclusions []string
+	SortKey    func(host *Host) lua.LValue
+	Limit      int
 }
 
 func NewHostQuery() *HostQuery {
@@ -46,6 +58,16 @@ func (hostQuery *HostQuery) AppendFilters(filters []string) *HostQuery {
 	return hostQuery
 }
 
+func (hostQuery *HostQuery) AppendPredicate(predicate func(host *Host) bool) *HostQuery {
+	hostQuery.Predicates = append(hostQuery.Predicates, predicate)
+	return hostQuery
+}
+
+func (hostQuery *HostQuery) AppendExclusions(exclusions []string) *HostQuery {
+	hostQuery.Exclusions = append(hostQuery.Exclusions, exclusions...)
+	return hostQuery
+}
+
 func (hostQuery *HostQuery) isHidden() *HostQuery {
 	b := true
 	hostQuery.Hidden = &b
@@ -59,11 +81,21 @@ func (hostQuery *HostQuery) isVisible() *HostQuery {
 	return hostQuery
 }
 
+func (hostQuery *HostQuery) includePatterns() *HostQuery {
+	hostQuery.Patterns = true
+	return hostQuery
+}
+
+func (hostQuery *HostQuery) includeAbstract() *HostQuery {
+	hostQuery.Abstract = true
+	return hostQuery
+}
+
 func (hostQuery *HostQuery) GetHosts() []*Host {
 	hosts := hostQuery.getHostsList()
-	hosts = hostQuery.selectHosts(hosts)
+	hosts = hostQuery.selectHosts(hosts, compileSelectors(hostQuery.Selections))
 
-	for _, filter := range hostQuery.Filters {
+	for _, filter := range compileSelectors(hostQuery.Filters) {
 		hosts = hostQuery.filterHosts(hosts, filter)
 	}
 
@@ -79,9 +111,101 @@ func (hostQuery *HostQuery) GetHosts() []*Host {
 		hosts = newHosts
 	}
 
+	if len(hostQuery.Predicates) > 0 || len(hostQuery.Exclusions) > 0 {
+		exclusions := compileSelectors(hostQuery.Exclusions)
+		newHosts := []*Host{}
+		for _, host := range hosts {
+			if hostQuery.matchConditions(host, exclusions) {
+				newHosts = append(newHosts, host)
+			}
+		}
+
+		hosts = newHosts
+	}
+
+	if hostQuery.SortKey != nil || hostQuery.Limit > 0 {
+		// sort by name first to make the order of the same keys and the limited hosts stable.
+		sort.Sort(NameSortableHosts(hosts))
+	}
+
+	if hostQuery.SortKey != nil {
+		keys := map[*Host]lua.LValue{}
+		for _, host := range hosts {
+			keys[host] = hostQuery.SortKey(host)
+		}
+		sort.SliceStable(hosts, func(i, j int) bool {
+			return lessHostSortKey(keys[hosts[i]], keys[hosts[j]])
+		})
+	}
+
+	if hostQuery.Limit > 0 && len(hosts) > hostQuery.Limit {
+		hosts = hosts[:hostQuery.Limit]
+	}
+
 	return hosts
 }
 
+// matchConditions returns true if the host satisfies all the predicates and doesn't match any exclusions.
+func (hostQuery *HostQuery) matchConditions(host *Host, exclusions []Selector) bool {
+	for _, predicate := range hostQuery.Predicates {
+		if !predicate(host) {
+			return false
+		}
+	}
+
+	for _, exclusion := range exclusions {
+		if exclusion.Match(host) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// GetHostsInOrder returns the hosts sorted by the query's sort key, or by name if the query isn't sorted.
+func (hostQuery *HostQuery) GetHostsInOrder() []*Host {
+	if hostQuery.SortKey != nil {
+		return hostQuery.GetHosts()
+	}
+
+	return hostQuery.GetHostsOrderByName()
+}
+
+// hostSortKeyByField returns the sort key of the host's field.
+// The field is "name", "description", "props.<key>" or other fields of the host like "HostName".
+func hostSortKeyByField(field string) func(host *Host) lua.LValue {
+	return func(host *Host) lua.LValue {
+		switch {
+		case field == "name":
+			return lua.LString(host.Name)
+		case field == "description":
+			return lua.LString(host.Description)
+		case strings.HasPrefix(field, "props."):
+			return lua.LString(host.Props[strings.TrimPrefix(field, "props.")])
+		}
+
+		if v, ok := host.LValues[field]; ok && v != nil {
+			return v
+		}
+		return lua.LNil
+	}
+}
+
+// lessHostSortKey compares the sort keys. Numbers are compared numerically, and nil is ordered last.
+func lessHostSortKey(a, b lua.LValue) bool {
+	if a == lua.LNil || b == lua.LNil {
+		return a != lua.LNil && b == lua.LNil
+	}
+
+	af, aerr := strconv.ParseFloat(a.String(), 64)
+	bf, berr := strconv.ParseFloat(b.String(), 64)
+	if aerr == nil && berr == nil {
+		return af < bf
+	}
+
+	return a.String() < b.String()
+}
+
 type NameSortableHosts []*Host
 
 func (h NameSortableHosts) Len() int {
@@ -104,37 +228,26 @@ func (hostQuery *HostQuery) GetHostsOrderByName() []*Host {
 	return hosts
 }
 
-func (hostQuery *HostQuery) selectHosts(hosts []*Host) []*Host {
-	if len(hostQuery.Selections) == 0 {
+func hostNames(hosts []*Host) []string {
+	names := []string{}
+	for _, host := range hosts {
+		names = append(names, host.Name)
+	}
+	return names
+}
+
+func (hostQuery *HostQuery) selectHosts(hosts []*Host, selections []Selector) []*Host {
+	if len(selections) == 0 {
 		return hosts
 	}
 
 	newHosts := []*Host{}
-	selections := hostQuery.Selections
 
 	for _, host := range hosts {
-		selected := false
-
-	B1:
 		for _, selection := range selections {
-			if host.Name == selection {
+			if selection.Match(host) {
 				newHosts = append(newHosts, host)
-				selected = true
-				break B1
-			}
-		}
-
-		if selected {
-			continue
-		}
-
-	B2:
-		for _, tag := range host.Tags {
-			for _, selection := range selections {
-				if tag == selection {
-					newHosts = append(newHosts, host)
-					break B2
-				}
+				break
 			}
 		}
 	}
@@ -142,19 +255,11 @@ func (hostQuery *HostQuery) selectHosts(hosts []*Host) []*Host {
 	return newHosts
 }
 
-func (hostQuery *HostQuery) filterHosts(hosts []*Host, filter string) []*Host {
+func (hostQuery *HostQuery) filterHosts(hosts []*Host, filter Selector) []*Host {
 	newHosts := []*Host{}
 	for _, host := range hosts {
-		if host.Name == filter {
+		if filter.Match(host) {
 			newHosts = append(newHosts, host)
-			continue
-		}
-
-		for _, tag := range host.Tags {
-			if tag == filter {
-				newHosts = append(newHosts, host)
-				break
-			}
 		}
 	}
 
@@ -164,6 +269,12 @@ func (hostQuery *HostQuery) filterHosts(hosts []*Host, filter string) []*Host {
 func (hostQuery *HostQuery) getHostsList() []*Host {
 	hostsSlice := []*Host{}
 	for _, host := range hostQuery.Datasource {
+		if host.IsPattern() && !hostQuery.Patterns {
+			continue
+		}
+		if host.Abstract && !hostQuery.Abstract {
+			continue
+		}
 		hostsSlice = append(hostsSlice, host)
 	}
 	return hostsSlice
@@ -191,6 +302,9 @@ func esshSelectHosts(L *lua.LState) int {
 		} else {
 			panic("select_hosts can receive string or array table of strings.")
 		}
+		if err := ValidateSelectors(selections); err != nil {
+			L.RaiseError("%v", err)
+		}
 		hostQuery.AppendSelections(selections)
 	}
 
@@ -247,6 +361,9 @@ func hostQueryIndex(L *lua.LState) int {
 				} else {
 					panic("filter can receive string or array table of strings.")
 				}
+				if err := ValidateSelectors(filters); err != nil {
+					L.RaiseError("%v", err)
+				}
 
 				hostQuery.AppendFilters(filters)
 			}
@@ -278,13 +395,119 @@ func hostQueryIndex(L *lua.LState) int {
 			return 1
 		}))
 
+		return 1
+	case "where":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			hostQuery := checkHostQuery(L)
+			ud := L.CheckUserData(1)
+			fn := L.CheckFunction(2)
+
+			hostQuery.AppendPredicate(func(host *Host) bool {
+				L.CallByParam(lua.P{
+					Fn:      fn,
+					NRet:    1,
+					Protect: false,
+				}, newLHost(L, host))
+				ret := L.Get(-1)
+				L.Pop(1)
+
+				return lua.LVAsBool(ret)
+			})
+
+			ud.Value = hostQuery
+			L.Push(ud)
+			return 1
+		}))
+
+		return 1
+	case "exclude":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			hostQuery := checkHostQuery(L)
+			ud := L.CheckUserData(1)
+			if L.GetTop() < 2 {
+				panic("exclude must receive at least 1 argument.")
+			}
+
+			exclusions := []string{}
+			for i := 2; i <= L.GetTop(); i++ {
+				value := L.CheckAny(i)
+				if exclusionStr, ok := toString(value); ok {
+					exclusions = append(exclusions, exclusionStr)
+				} else if exclusionsSlice, ok := toSlice(value); ok {
+					for _, exclusion := range exclusionsSlice {
+						if exclusionStr, ok := exclusion.(string); ok {
+							exclusions = append(exclusions, exclusionStr)
+						}
+					}
+				} else {
+					panic("exclude can receive strings or array tables of strings.")
+				}
+			}
+			if err := ValidateSelectors(exclusions); err != nil {
+				L.RaiseError("%v", err)
+			}
+
+			hostQuery.AppendExclusions(exclusions)
+
+			ud.Value = hostQuery
+			L.Push(ud)
+			return 1
+		}))
+
+		return 1
+	case "sort_by":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			hostQuery := checkHostQuery(L)
+			ud := L.CheckUserData(1)
+
+			switch value := L.CheckAny(2).(type) {
+			case lua.LString:
+				hostQuery.SortKey = hostSortKeyByField(string(value))
+			case *lua.LFunction:
+				hostQuery.SortKey = func(host *Host) lua.LValue {
+					L.CallByParam(lua.P{
+						Fn:      value,
+						NRet:    1,
+						Protect: false,
+					}, newLHost(L, host))
+					ret := L.Get(-1)
+					L.Pop(1)
+
+					return ret
+				}
+			default:
+				panic("sort_by can receive a field name or a function.")
+			}
+
+			ud.Value = hostQuery
+			L.Push(ud)
+			return 1
+		}))
+
+		return 1
+	case "limit":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			hostQuery := checkHostQuery(L)
+			ud := L.CheckUserData(1)
+			n := L.CheckInt(2)
+			if n < 1 {
+				L.ArgError(2, "limit must be a positive number")
+			}
+
+			hostQuery.Limit = n
+
+			ud.Value = hostQuery
+			L.Push(ud)
+			return 1
+		}))
+
 		return 1
 	case "get":
 		L.Push(L.NewFunction(func(L *lua.LState) int {
 			hostQuery := checkHostQuery(L)
 
 			lhosts := L.NewTable()
-			for _, host := range hostQuery.GetHosts() {
+			for _, host := range hostQuery.GetHostsInOrder() {
 				lhost := newLHost(L, host)
 				lhosts.Append(lhost)
 			}
@@ -296,20 +519,57 @@ func hostQueryIndex(L *lua.LState) int {
 		return 1
 	case "first":
 		L.Push(L.NewFunction(func(L *lua.LState) int {
-			L.Push(L.NewFunction(func(L *lua.LState) int {
-				hostQuery := checkHostQuery(L)
+			hostQuery := checkHostQuery(L)
 
-				hosts := hostQuery.GetHosts()
-				if len(hosts) > 0 {
-					L.Push(newLHost(L, hosts[0]))
-					return 1
-				}
-				L.Push(lua.LNil)
+			hosts := hostQuery.GetHostsInOrder()
+			if len(hosts) > 0 {
+				L.Push(newLHost(L, hosts[0]))
 				return 1
-			}))
+			}
+			L.Push(lua.LNil)
 			return 1
 		}))
-		L.Push(lua.LNil)
+
+		return 1
+	case "count":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			hostQuery := checkHostQuery(L)
+
+			L.Push(lua.LNumber(len(hostQuery.GetHosts())))
+			return 1
+		}))
+
+		return 1
+	case "names":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			hostQuery := checkHostQuery(L)
+
+			names := L.NewTable()
+			for _, host := range hostQuery.GetHostsInOrder() {
+				names.Append(lua.LString(host.Name))
+			}
+
+			L.Push(names)
+			return 1
+		}))
+
+		return 1
+	case "each":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			hostQuery := checkHostQuery(L)
+			fn := L.CheckFunction(2)
+
+			for _, host := range hostQuery.GetHostsInOrder() {
+				L.CallByParam(lua.P{
+					Fn:      fn,
+					NRet:    0,
+					Protect: false,
+				}, newLHost(L, host))
+			}
+
+			return 0
+		}))
+
 		return 1
 	default:
 		L.Push(lua.LNil)
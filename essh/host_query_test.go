@@ -0,0 +1,181 @@
+package essh
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// newTestLState returns a lua state that has loaded the config. The resources like Hosts are initialized.
+func newTestLState(t *testing.T, config string) *lua.LState {
+	initResources()
+	t.Cleanup(initResources)
+
+	L := lua.NewState()
+	t.Cleanup(L.Close)
+	InitLuaState(L)
+	if err := L.DoString(config); err != nil {
+		t.Fatalf("failed to load the config: %v", err)
+	}
+
+	return L
+}
+
+const testHostQueryConfig = `
+for i = 1, 5 do
+    host ("web0" .. i) {
+        tags = {"web"},
+        props = { weight = tostring(12 - i * 2), zone = (i % 2 == 0) and "a" or "b" },
+    }
+end
+host "db01" { tags = {"db"}, props = { weight = "1", zone = "a" } }
+`
+
+func TestHostQueryMethods(t *testing.T) {
+	L := newTestLState(t, testHostQueryConfig)
+
+	cases := []struct {
+		desc     string
+		code     string
+		expected string
+	}{
+		{
+			desc:     "names are ordered by name",
+			code:     `return table.concat(essh.select_hosts("web"):names(), ",")`,
+			expected: "web01,web02,web03,web04,web05",
+		},
+		{
+			desc:     "where",
+			code:     `return table.concat(essh.select_hosts():where(function(h) return tonumber(h.props.weight) < 7 end):names(), ",")`,
+			expected: "db01,web03,web04,web05",
+		},
+		{
+			desc:     "exclude names and tables",
+			code:     `return table.concat(essh.select_hosts("web"):exclude("web01", {"web02", "web03"}):names(), ",")`,
+			expected: "web04,web05",
+		},
+		{
+			desc:     "exclude selector expressions",
+			code:     `return table.concat(essh.select_hosts():exclude("db || props.zone=a"):names(), ",")`,
+			expected: "web01,web03,web05",
+		},
+		{
+			desc:     "sort_by compares numbers numerically",
+			code:     `return table.concat(essh.select_hosts("web"):sort_by("props.weight"):names(), ",")`,
+			expected: "web05,web04,web03,web02,web01",
+		},
+		{
+			desc:     "sort_by keeps the order of the same keys by name",
+			code:     `return table.concat(essh.select_hosts():sort_by("props.zone"):names(), ",")`,
+			expected: "db01,web02,web04,web01,web03,web05",
+		},
+		{
+			desc:     "sort_by a function",
+			code:     `return table.concat(essh.select_hosts("web"):sort_by(function(h) return -tonumber(h.props.weight) end):names(), ",")`,
+			expected: "web01,web02,web03,web04,web05",
+		},
+		{
+			desc:     "limit after sort_by",
+			code:     `return table.concat(essh.select_hosts("web"):sort_by("props.weight"):limit(2):names(), ",")`,
+			expected: "web05,web04",
+		},
+		{
+			desc:     "limit without sort_by",
+			code:     `return table.concat(essh.select_hosts("web"):limit(2):names(), ",")`,
+			expected: "web01,web02",
+		},
+		{
+			desc:     "conditions are applied before sort_by and limit",
+			code:     `return table.concat(essh.select_hosts("web"):where(function(h) return h.props.zone == "b" end):exclude("web05"):sort_by("props.weight"):limit(1):names(), ",")`,
+			expected: "web03",
+		},
+		{
+			desc:     "count",
+			code:     `return tostring(essh.select_hosts("web"):exclude("web01"):count())`,
+			expected: "4",
+		},
+		{
+			desc:     "count with limit",
+			code:     `return tostring(essh.select_hosts("web"):limit(3):count())`,
+			expected: "3",
+		},
+		{
+			desc:     "first",
+			code:     `return essh.select_hosts("web"):sort_by("props.weight"):first():name()`,
+			expected: "web05",
+		},
+		{
+			desc:     "first of no hosts",
+			code:     `return tostring(essh.select_hosts("unknown"):first())`,
+			expected: "nil",
+		},
+		{
+			desc:     "each",
+			code:     `local names = {}; essh.select_hosts("web"):sort_by("props.weight"):limit(3):each(function(h) table.insert(names, h:name()) end); return table.concat(names, ",")`,
+			expected: "web05,web04,web03",
+		},
+	}
+
+	for _, c := range cases {
+		if err := L.DoString(c.code); err != nil {
+			t.Errorf("%s: unexpected error: %v", c.desc, err)
+			continue
+		}
+		ret := L.Get(-1)
+		L.Pop(1)
+		if ret.String() != c.expected {
+			t.Errorf("%s: expected '%s', but got '%s'", c.desc, c.expected, ret.String())
+		}
+	}
+}
+
+func TestTaskTargetsKeepHostQueryOrder(t *testing.T) {
+	L := newTestLState(t, testHostQueryConfig+`
+task "roll" {
+    targets = essh.select_hosts("web"):sort_by("props.weight"):limit(3),
+    script = "uptime",
+}
+task "roll-filtered" {
+    targets = essh.select_hosts("web"):sort_by("props.weight"),
+    filters = "props.zone=a",
+    script = "uptime",
+}
+task "names" {
+    targets = {"web05", "web01", "web03"},
+    script = "uptime",
+}
+`)
+
+	cases := []struct {
+		task     string
+		expected []string
+	}{
+		{task: "roll", expected: []string{"web05", "web04", "web03"}},
+		{task: "roll-filtered", expected: []string{"web04", "web02"}},
+		{task: "names", expected: []string{"web01", "web03", "web05"}},
+	}
+
+	for _, c := range cases {
+		task := Tasks[c.task]
+		if err := resolveTaskTargets(task, L); err != nil {
+			t.Errorf("%s: unexpected error: %v", c.task, err)
+			continue
+		}
+		if names := hostNames(selectTaskHosts(task)); !reflect.DeepEqual(names, c.expected) {
+			t.Errorf("%s: expected %v, but got %v", c.task, c.expected, names)
+		}
+	}
+
+	// the query is evaluated again with the hosts defined after the assignment.
+	if err := L.DoString(`host "web00" { tags = {"web"}, props = { weight = "0", zone = "a" } }`); err != nil {
+		t.Fatal(err)
+	}
+	if err := resolveTaskTargets(Tasks["roll"], L); err != nil {
+		t.Fatal(err)
+	}
+	if names := strings.Join(hostNames(selectTaskHosts(Tasks["roll"])), ","); names != "web00,web05,web04" {
+		t.Errorf("expected the hosts resolved again, but got %s", names)
+	}
+}
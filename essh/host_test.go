@@ -0,0 +1,213 @@
+package essh
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestHost returns a host for tests. The tags and the props are optional.
+func newTestHost(name string, tags []string, props map[string]string) *Host {
+	host := NewHost()
+	host.Name = name
+	if tags != nil {
+		host.Tags = tags
+	}
+	if props != nil {
+		host.Props = props
+	}
+
+	return host
+}
+
+func newTestHosts(names ...string) []*Host {
+	hosts := []*Host{}
+	for _, name := range names {
+		hosts = append(hosts, newTestHost(name, nil, nil))
+	}
+
+	return hosts
+}
+
+func TestHostIsPattern(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected bool
+	}{
+		{name: "web01", expected: false},
+		{name: "web01.example.com", expected: false},
+		{name: "*", expected: true},
+		{name: "*.internal", expected: true},
+		{name: "web0?", expected: true},
+		{name: "web-[01]", expected: false},
+	}
+
+	for _, c := range cases {
+		if v := newTestHosts(c.name)[0].IsPattern(); v != c.expected {
+			t.Errorf("%s: expected %v, but got %v", c.name, c.expected, v)
+		}
+	}
+}
+
+func TestSortHostsForSSHConfig(t *testing.T) {
+	cases := []struct {
+		names    []string
+		expected []string
+	}{
+		{
+			names:    []string{"web02", "web01", "db01"},
+			expected: []string{"web02", "web01", "db01"},
+		},
+		{
+			names:    []string{"*", "web02", "*.internal", "web01", "*.prod.internal", "db01"},
+			expected: []string{"web02", "web01", "db01", "*.prod.internal", "*.internal", "*"},
+		},
+		{
+			names:    []string{"web0?", "*.internal", "bastion"},
+			expected: []string{"bastion", "*.internal", "web0?"},
+		},
+		{
+			names:    []string{"a*", "b*", "web01"},
+			expected: []string{"web01", "a*", "b*"},
+		},
+	}
+
+	for _, c := range cases {
+		hosts := newTestHosts(c.names...)
+		sorted := hostNames(sortHostsForSSHConfig(hosts))
+		if !reflect.DeepEqual(sorted, c.expected) {
+			t.Errorf("%v: expected %v, but got %v", c.names, c.expected, sorted)
+		}
+		if !reflect.DeepEqual(hostNames(hosts), c.names) {
+			t.Errorf("%v: the given hosts must not be modified, but got %v", c.names, hostNames(hosts))
+		}
+	}
+}
+
+const testHostExtendsConfig = `
+host "base-a" {
+    abstract = true,
+    HostName = "192.168.0.1",
+    User = "a",
+    Port = "2201",
+    props = { x = "a", y = "a" },
+    tags = {"a", "common"},
+    hooks_before_connect = {"echo a"},
+}
+host "base-b" {
+    abstract = true,
+    hidden = true,
+    User = "b",
+    aliases = {"bb"},
+    props = { y = "b", z = "b" },
+    tags = {"b", "common"},
+    hooks_before_connect = {"echo b"},
+}
+host "web01" {
+    extends = {"base-a", "base-b"},
+    Port = "22",
+    props = { z = "web" },
+    tags = {"web", "common"},
+    hooks_before_connect = {"echo web"},
+}
+host "web02" {
+    extends = {"base-b", "base-a"},
+}
+`
+
+func TestHostExtends(t *testing.T) {
+	newTestLState(t, testHostExtendsConfig)
+
+	cases := []struct {
+		name      string
+		sshConfig map[string]string
+		props     map[string]string
+		tags      []string
+		hooks     []interface{}
+	}{
+		{
+			name:      "web01",
+			sshConfig: map[string]string{"HostName": "192.168.0.1", "User": "b", "Port": "22"},
+			props:     map[string]string{"x": "a", "y": "b", "z": "web"},
+			tags:      []string{"web", "common", "b", "a"},
+			hooks:     []interface{}{"echo a", "echo b", "echo web"},
+		},
+		{
+			name:      "web02",
+			sshConfig: map[string]string{"HostName": "192.168.0.1", "User": "a", "Port": "2201"},
+			props:     map[string]string{"x": "a", "y": "a", "z": "b"},
+			tags:      []string{"a", "common", "b"},
+			hooks:     []interface{}{"echo b", "echo a"},
+		},
+	}
+
+	for _, c := range cases {
+		host := Hosts[c.name]
+		if !reflect.DeepEqual(host.SSHConfig, c.sshConfig) {
+			t.Errorf("%s: expected the ssh config %v, but got %v", c.name, c.sshConfig, host.SSHConfig)
+		}
+		if !reflect.DeepEqual(host.Props, c.props) {
+			t.Errorf("%s: expected the props %v, but got %v", c.name, c.props, host.Props)
+		}
+		if !reflect.DeepEqual(host.Tags, c.tags) {
+			t.Errorf("%s: expected the tags %v, but got %v", c.name, c.tags, host.Tags)
+		}
+		if !reflect.DeepEqual(host.HooksBeforeConnect, c.hooks) {
+			t.Errorf("%s: expected the hooks %v, but got %v", c.name, c.hooks, host.HooksBeforeConnect)
+		}
+		if host.Abstract || host.Hidden || len(host.Aliases) != 0 {
+			t.Errorf("%s: abstract, hidden and aliases must not be inherited", c.name)
+		}
+	}
+}
+
+func TestAbstractHosts(t *testing.T) {
+	newTestLState(t, testHostExtendsConfig)
+
+	cases := []struct {
+		desc       string
+		selections []string
+		expected   []string
+	}{
+		{desc: "all", selections: []string{}, expected: []string{"web01", "web02"}},
+		{desc: "name", selections: []string{"base-a"}, expected: []string{}},
+		{desc: "glob", selections: []string{"base-*"}, expected: []string{}},
+		{desc: "tag", selections: []string{"common"}, expected: []string{"web01", "web02"}},
+	}
+
+	for _, c := range cases {
+		names := hostNames(NewHostQuery().AppendSelections(c.selections).GetHostsOrderByName())
+		if !reflect.DeepEqual(names, c.expected) {
+			t.Errorf("%s: expected %v, but got %v", c.desc, c.expected, names)
+		}
+	}
+
+	all := hostNames(NewHostQuery().includeAbstract().GetHostsOrderByName())
+	if expected := []string{"base-a", "base-b", "web01", "web02"}; !reflect.DeepEqual(all, expected) {
+		t.Errorf("expected %v with the abstract hosts, but got %v", expected, all)
+	}
+
+	allHosts := []*Host{}
+	for _, host := range Hosts {
+		allHosts = append(allHosts, host)
+	}
+	b, err := GenHostsConfig(allHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "base-") || strings.Contains(string(b), "bb") || !strings.Contains(string(b), "web01") {
+		t.Errorf("the abstract hosts must not be written to ssh_config, but got\n%s", b)
+	}
+
+	for _, name := range []string{"base-a", "base-b", "bb"} {
+		if host := FindHost(name); host != nil {
+			t.Errorf("%s: the abstract host must not be found, but got %s", name, host.Name)
+		}
+		if config := effectiveSSHConfig(name); len(config) != 0 {
+			t.Errorf("%s: the abstract host must not be applied, but got %v", name, config)
+		}
+	}
+	if host := FindHost("web01"); host == nil || host.Name != "web01" {
+		t.Errorf("web01 must be found, but got %v", host)
+	}
+}
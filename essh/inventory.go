@@ -0,0 +1,406 @@
+package essh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/sevir/essh/support/color"
+	lua "github.com/yuin/gopher-lua"
+	gluajson "layeh.com/gopher-json"
+)
+
+// Inventory is a dynamic source of hosts. The hosts returned by its fetch function or command are registered like hosts defined by `host`.
+type Inventory struct {
+	Name string
+	// Fetch returns the JSON of the host definitions.
+	Fetch func() ([]byte, error)
+	// TTL is the time to use the cached hosts. The hosts are fetched every time if it is zero.
+	TTL      time.Duration
+	Tags     []string
+	Registry *Registry
+	// ConfigFile is the config file that defines the inventory. It is a part of the cache key.
+	ConfigFile string
+	LValues    map[string]lua.LValue
+}
+
+// DefaultInventoryTTL is the TTL of the inventories that don't set 'ttl'.
+const DefaultInventoryTTL = 5 * time.Minute
+
+var Inventories map[string]*Inventory
+
+var inventoryNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+func NewInventory() *Inventory {
+	return &Inventory{
+		TTL:     DefaultInventoryTTL,
+		Tags:    []string{},
+		LValues: map[string]lua.LValue{},
+	}
+}
+
+// inventoryCache is the content of the cache file of an inventory.
+type inventoryCache struct {
+	FetchedAt time.Time       `json:"fetched_at"`
+	Hosts     json.RawMessage `json:"hosts"`
+}
+
+// CacheFile returns the path of the cache file. It is keyed by the config file and the name,
+// because config files that share a registry's data directory may define inventories of the same name.
+func (inv *Inventory) CacheFile() string {
+	key := fmt.Sprintf("%x", sha256.Sum256([]byte(inv.ConfigFile)))
+	return filepath.Join(inv.Registry.InventoryDir(), inv.Name+"-"+key[:16]+".json")
+}
+
+func (inv *Inventory) readCache() *inventoryCache {
+	b, err := os.ReadFile(inv.CacheFile())
+	if err != nil {
+		return nil
+	}
+
+	cache := &inventoryCache{}
+	if err := json.Unmarshal(b, cache); err != nil {
+		return nil
+	}
+
+	return cache
+}
+
+func (inv *Inventory) writeCache(hosts []byte) error {
+	if err := os.MkdirAll(inv.Registry.InventoryDir(), os.FileMode(0700)); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(&inventoryCache{FetchedAt: time.Now(), Hosts: hosts})
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(inv.CacheFile(), b, 0600)
+}
+
+// loadInventory registers the hosts of the inventory.
+// It uses the cached hosts until the TTL expires, and also when fetching the hosts failed.
+func loadInventory(L *lua.LState, inv *Inventory) error {
+	var hosts []byte
+
+	cache := inv.readCache()
+	if cache != nil && !refreshInventoryFlag && inv.TTL > 0 && time.Since(cache.FetchedAt) < inv.TTL {
+		if debugFlag {
+			fmt.Printf("[essh debug] use the cached hosts of the inventory: %s\n", inv.Name)
+		}
+		hosts = cache.Hosts
+	} else {
+		if debugFlag {
+			fmt.Printf("[essh debug] fetch the hosts of the inventory: %s\n", inv.Name)
+		}
+
+		fetched, err := inv.Fetch()
+		if err != nil {
+			if cache == nil {
+				return fmt.Errorf("inventory '%s' failed to fetch hosts: %v", inv.Name, err)
+			}
+			fmt.Fprint(os.Stderr, color.FgYB("essh: inventory '%s' failed to fetch hosts. the cached hosts are used: %v\n", inv.Name, err))
+			hosts = cache.Hosts
+		} else {
+			hosts = fetched
+			// the cache is also written without the TTL to use it when fetching fails.
+			if err := inv.writeCache(hosts); err != nil {
+				return fmt.Errorf("inventory '%s' failed to write the cache: %v", inv.Name, err)
+			}
+		}
+	}
+
+	lhosts, err := gluajson.Decode(L, hosts)
+	if err != nil {
+		return fmt.Errorf("inventory '%s' returned invalid hosts: %v", inv.Name, err)
+	}
+
+	return registerInventoryHosts(L, inv, lhosts)
+}
+
+// registerInventoryHosts registers hosts from a table keyed by the host names or an array of tables that have `name`.
+func registerInventoryHosts(L *lua.LState, inv *Inventory, value lua.LValue) error {
+	tb, ok := toLTable(value)
+	if !ok {
+		return fmt.Errorf("inventory '%s' must return a table of hosts.", inv.Name)
+	}
+
+	names := []string{}
+	configs := map[string]*lua.LTable{}
+	if tb.MaxN() > 0 {
+		for i := 1; i <= tb.MaxN(); i++ {
+			config, ok := toLTable(tb.RawGetInt(i))
+			if !ok {
+				return fmt.Errorf("inventory '%s' returned a host that is not a table.", inv.Name)
+			}
+			name, ok := toString(config.RawGetString("name"))
+			if !ok || name == "" {
+				return fmt.Errorf("inventory '%s' returned a host that doesn't have 'name'.", inv.Name)
+			}
+			config.RawSetString("name", lua.LNil)
+			names = append(names, name)
+			configs[name] = config
+		}
+	} else {
+		var err error
+		tb.ForEach(func(k, v lua.LValue) {
+			name, ok := toString(k)
+			config, ok2 := toLTable(v)
+			if (!ok || !ok2) && err == nil {
+				err = fmt.Errorf("inventory '%s' must return a table of host's configs keyed by the names.", inv.Name)
+				return
+			}
+			names = append(names, name)
+			configs[name] = config
+		})
+		if err != nil {
+			return err
+		}
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+		config := configs[name]
+		if len(inv.Tags) > 0 {
+			config.RawSetString("tags", mergeInventoryTags(L, config.RawGetString("tags"), inv.Tags))
+		}
+
+		h := registerHost(L, name)
+		setupHost(L, h, config)
+	}
+
+	return nil
+}
+
+// mergeInventoryTags returns the tags of a host with the inventory's tags.
+func mergeInventoryTags(L *lua.LState, value lua.LValue, invTags []string) *lua.LTable {
+	tags := L.NewTable()
+	exists := map[string]bool{}
+	if tagStr, ok := toString(value); ok {
+		tags.Append(lua.LString(tagStr))
+		exists[tagStr] = true
+	} else if tb, ok := toLTable(value); ok {
+		for i := 1; i <= tb.MaxN(); i++ {
+			tag := tb.RawGetInt(i)
+			tags.Append(tag)
+			exists[tag.String()] = true
+		}
+	}
+
+	for _, tag := range invTags {
+		if !exists[tag] {
+			tags.Append(lua.LString(tag))
+		}
+	}
+
+	return tags
+}
+
+// fetchByCommand runs the command and returns the JSON that it printed to stdout.
+func fetchByCommand(command string) ([]byte, error) {
+	var shell, flag string
+	if runtime.GOOS == "windows" {
+		shell = "cmd"
+		flag = "/C"
+	} else {
+		shell = "bash"
+		flag = "-c"
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(shell, flag, command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	if !json.Valid(stdout.Bytes()) {
+		return nil, fmt.Errorf("the command must print JSON.")
+	}
+
+	return stdout.Bytes(), nil
+}
+
+func esshInventory(L *lua.LState) int {
+	name := L.CheckString(1)
+	if L.GetTop() == 1 {
+		// DSL style
+		inv := registerInventory(L, name)
+		L.Push(newLInventory(L, inv))
+
+		return 1
+	} else if L.GetTop() == 2 {
+		// function style
+		tb := L.CheckTable(2)
+		inv := registerInventory(L, name)
+		setupInventory(L, inv, tb)
+		L.Push(newLInventory(L, inv))
+
+		return 1
+	}
+
+	panic("inventory requires 1 or 2 arguments")
+}
+
+func registerInventory(L *lua.LState, name string) *Inventory {
+	if debugFlag {
+		fmt.Printf("[essh debug] register inventory: %s\n", name)
+	}
+
+	if !inventoryNameRegexp.MatchString(name) {
+		L.RaiseError("invalid inventory name '%s'.", name)
+	}
+
+	if _, ok := Inventories[name]; ok {
+		L.RaiseError("inventory '%s' is already defined.", name)
+	}
+
+	inv := NewInventory()
+	inv.Name = name
+	inv.Registry = CurrentRegistry
+	inv.ConfigFile = CurrentConfigFile
+
+	Inventories[inv.Name] = inv
+
+	return inv
+}
+
+// setupInventory sets the config and registers the hosts of the inventory.
+func setupInventory(L *lua.LState, inv *Inventory, config *lua.LTable) {
+	config.ForEach(func(k, v lua.LValue) {
+		if kstr, ok := toString(k); ok {
+			updateInventory(L, inv, kstr, v)
+		}
+	})
+
+	if inv.Fetch == nil {
+		L.RaiseError("inventory '%s' requires 'fetch'.", inv.Name)
+	}
+
+	if err := loadInventory(L, inv); err != nil {
+		L.RaiseError("%v", err)
+	}
+}
+
+func updateInventory(L *lua.LState, inv *Inventory, key string, value lua.LValue) {
+	inv.LValues[key] = value
+
+	switch key {
+	case "fetch":
+		if fetchFn, ok := value.(*lua.LFunction); ok {
+			inv.Fetch = func() ([]byte, error) {
+				err := L.CallByParam(lua.P{
+					Fn:      fetchFn,
+					NRet:    1,
+					Protect: true,
+				})
+				if err != nil {
+					return nil, err
+				}
+
+				ret := L.Get(-1) // returned value
+				L.Pop(1)
+
+				if _, ok := toLTable(ret); !ok {
+					return nil, fmt.Errorf("fetch must return a table of hosts.")
+				}
+				return gluajson.Encode(ret)
+			}
+		} else if command, ok := toString(value); ok {
+			inv.Fetch = func() ([]byte, error) {
+				return fetchByCommand(command)
+			}
+		} else {
+			L.RaiseError("inventory 'fetch' must be a function or a command string.")
+		}
+	case "ttl":
+		ttl, ok := toDuration(value)
+		if !ok {
+			L.RaiseError("inventory 'ttl' must be a duration like '10m'.")
+		}
+		inv.TTL = ttl
+	case "tags":
+		if tagStr, ok := toString(value); ok {
+			inv.Tags = []string{tagStr}
+		} else if tagsSlice, ok := toSlice(value); ok {
+			inv.Tags = []string{}
+			for _, tag := range tagsSlice {
+				if tagStr, ok := tag.(string); ok {
+					inv.Tags = append(inv.Tags, tagStr)
+				}
+			}
+		} else {
+			L.RaiseError("inventory 'tags' must be a string or a table.")
+		}
+	}
+}
+
+const LInventoryClass = "Inventory*"
+
+func registerInventoryClass(L *lua.LState) {
+	mt := L.NewTypeMetatable(LInventoryClass)
+	mt.RawSetString("__call", L.NewFunction(inventoryCall))
+	mt.RawSetString("__index", L.NewFunction(inventoryIndex))
+	mt.RawSetString("__newindex", L.NewFunction(inventoryNewindex))
+}
+
+func newLInventory(L *lua.LState, inv *Inventory) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = inv
+	L.SetMetatable(ud, L.GetTypeMetatable(LInventoryClass))
+	return ud
+}
+
+func checkInventory(L *lua.LState) *Inventory {
+	ud := L.CheckUserData(1)
+	if v, ok := ud.Value.(*Inventory); ok {
+		return v
+	}
+	L.ArgError(1, "Inventory object expected")
+	return nil
+}
+
+func inventoryCall(L *lua.LState) int {
+	inv := checkInventory(L)
+	tb := L.CheckTable(2)
+
+	setupInventory(L, inv, tb)
+
+	L.Push(L.CheckUserData(1))
+	return 1
+}
+
+func inventoryIndex(L *lua.LState) int {
+	inv := checkInventory(L)
+	index := L.CheckString(2)
+
+	if index == "name" {
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LString(inv.Name))
+			return 1
+		}))
+		return 1
+	}
+
+	v, ok := inv.LValues[index]
+	if v == nil || !ok {
+		v = lua.LNil
+	}
+
+	L.Push(v)
+	return 1
+}
+
+func inventoryNewindex(L *lua.LState) int {
+	panic("unsupport to override inventory's properties")
+}
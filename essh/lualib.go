@@ -3,6 +3,7 @@ package essh
 import (
 	"fmt"
 	"net/http"
+	"os"
 
 	strings "github.com/chai2010/glua-strings"
 	"github.com/cjoudrey/gluahttp"
@@ -37,12 +38,14 @@ func InitLuaState(L *lua.LState) {
 	registerHostQueryClass(L)
 	registerRegistryClass(L)
 	registerGroupClass(L)
+	registerInventoryClass(L)
 
 	// global functions
 	L.SetGlobal("host", L.NewFunction(esshHost))
 	L.SetGlobal("task", L.NewFunction(esshTask))
 	L.SetGlobal("driver", L.NewFunction(esshDriver))
 	L.SetGlobal("group", L.NewFunction(esshGroup))
+	L.SetGlobal("inventory", L.NewFunction(esshInventory))
 
 	// modules
 	L.PreloadModule("json", gluajson.Loader)
@@ -78,15 +81,20 @@ func InitLuaState(L *lua.LState) {
 
 	L.SetFuncs(lessh, map[string]lua.LGFunction{
 		// aliases global function.
-		"host":   esshHost,
-		"task":   esshTask,
-		"driver": esshDriver,
-		"group":  esshGroup,
+		"host":      esshHost,
+		"task":      esshTask,
+		"driver":    esshDriver,
+		"group":     esshGroup,
+		"inventory": esshInventory,
 
 		// utility functions
-		"debug":            esshDebug,
-		"select_hosts":     esshSelectHosts,
-		"current_registry": esshCurrentRegistry,
+		"debug":                  esshDebug,
+		"select_hosts":           esshSelectHosts,
+		"current_registry":       esshCurrentRegistry,
+		"run_task":               esshRunTask,
+		"exec":                   esshExec,
+		"load_ssh_config":        esshLoadSSHConfig,
+		"load_ansible_inventory": esshLoadAnsibleInventory,
 	})
 }
 
@@ -104,6 +112,84 @@ func esshCurrentRegistry(L *lua.LState) int {
 	return 1
 }
 
+// esshRunTask runs the task like `essh <task> <args...>` and returns the results table and the error message.
+// The outputs of the task are always captured to be used by the caller.
+func esshRunTask(L *lua.LState) int {
+	name := L.CheckString(1)
+	args := []string{}
+	if L.GetTop() >= 2 && L.Get(2) != lua.LNil {
+		argstb := L.CheckTable(2)
+		for i := 1; i <= argstb.MaxN(); i++ {
+			args = append(args, argstb.RawGetInt(i).String())
+		}
+	}
+
+	task := GetEnabledTask(name)
+	if task == nil {
+		L.RaiseError("task '%s' is not defined or disabled.", name)
+	}
+
+	if isRunningTask(task.Name) {
+		L.RaiseError("task '%s' is already running. it can't be run recursively.", name)
+	}
+
+	results, err := runTaskWithResults(luaSSHConfig(L), task, args, L)
+
+	return pushLHostResults(L, results, err)
+}
+
+// esshExec runs the script on the target hosts like `essh --exec` and returns the results table and the error message.
+// It receives a table of the task's fields. The default backend is remote.
+func esshExec(L *lua.LState) int {
+	config := L.CheckTable(1)
+
+	task := NewTask()
+	task.Name = "--exec"
+	task.Backend = TASK_BACKEND_REMOTE
+	setupTask(L, task, config)
+
+	if len(task.Targets) == 0 && len(task.Filters) > 0 {
+		L.RaiseError("filters must be used with targets.")
+	}
+
+	results, err := runTaskWithResults(luaSSHConfig(L), task, []string{}, L)
+
+	return pushLHostResults(L, results, err)
+}
+
+func pushLHostResults(L *lua.LState, results []*HostResult, err error) int {
+	L.Push(newLHostResults(L, results, true))
+	if err != nil {
+		L.Push(lua.LString(err.Error()))
+	} else {
+		L.Push(lua.LNil)
+	}
+
+	return 2
+}
+
+// luaSSHConfig returns the path of the ssh_config for running tasks from lua.
+// It generates the contents if they have not been generated yet like in --eval-file.
+func luaSSHConfig(L *lua.LState) string {
+	lessh, ok := toLTable(L.GetGlobal("essh"))
+	if !ok {
+		L.RaiseError("essh must be a table")
+	}
+
+	config, ok := toString(lessh.RawGetString("ssh_config"))
+	if !ok {
+		L.RaiseError("invalid value %v in the 'ssh_config'", lessh.RawGetString("ssh_config"))
+	}
+
+	if info, err := os.Stat(config); err != nil || info.Size() == 0 {
+		if _, err := UpdateSSHConfig(config, NewHostQuery().includePatterns().GetHostsOrderByName()); err != nil {
+			L.RaiseError("%v", err)
+		}
+	}
+
+	return config
+}
+
 // This code inspired by https://github.com/yuin/gluamapper/blob/master/gluamapper.go
 func toGoValue(lv lua.LValue) interface{} {
 	switch v := lv.(type) {
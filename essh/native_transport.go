@@ -0,0 +1,637 @@
+package essh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultNativeConnectTimeout is used when the host doesn't have ConnectTimeout.
+const defaultNativeConnectTimeout = 30 * time.Second
+
+// taskTransport returns the transport to run the task on the host.
+// The --transport option overrides the task's transport, and the task's one overrides the host's one.
+func taskTransport(task *Task, host *Host) string {
+	if transportVar != "" {
+		return transportVar
+	}
+
+	if task.Transport != "" {
+		return task.Transport
+	}
+
+	if host != nil && host.Transport != "" {
+		return host.Transport
+	}
+
+	return TRANSPORT_SSH
+}
+
+// nativeCommand returns the command that runs the script in a session of the native transport.
+// It is the same as the command that the ssh command sends.
+func nativeCommand(script string) string {
+	return "bash -c " + ShellEscape(script)
+}
+
+// NativeConnectionError is returned when the native transport couldn't connect to a host.
+type NativeConnectionError struct {
+	Host string
+	Err  error
+}
+
+func (e *NativeConnectionError) Error() string {
+	return fmt.Sprintf("couldn't connect to %s: %v", e.Host, e.Err)
+}
+
+func (e *NativeConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// nativeExitCode returns the exit code for the error of the native transport.
+// It behaves like the ssh command that exits with 255 when an error occurred in the connection.
+func nativeExitCode(err error) (int, bool) {
+	var exitErr *ssh.ExitError
+	var missingErr *ssh.ExitMissingError
+	var connErr *NativeConnectionError
+
+	if errors.As(err, &exitErr) {
+		if exitErr.ExitStatus() == 0 && exitErr.Signal() != "" {
+			return 255, true
+		}
+		return exitErr.ExitStatus(), true
+	} else if errors.As(err, &missingErr) || errors.As(err, &connErr) {
+		return 255, true
+	}
+
+	return 0, false
+}
+
+// checkNativeTask returns an error if the task has the settings that the native transport can't apply.
+func checkNativeTask(task *Task) error {
+	if len(task.SSHOptions) > 0 {
+		return fmt.Errorf("the native transport doesn't support ssh_options of the task '%s'. use the ssh transport or set the options to the hosts", task.Name)
+	}
+
+	return nil
+}
+
+func runNativeTaskScript(ctx context.Context, sshConfigPath string, task *Task, host *Host, hosts []*Host, stdinCh chan []byte, m *sync.Mutex, r *HostResult) error {
+	if err := checkNativeTask(task); err != nil {
+		return err
+	}
+
+	c, err := newRemoteTaskCommand(sshConfigPath, task, host)
+	if err != nil {
+		return err
+	}
+
+	r.Script = c.Script
+
+	session, ep, err := newNativeSession(ctx, host)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	if task.Pty {
+		if err := session.RequestPty("xterm", 40, 80, ssh.TerminalModes{}); err != nil {
+			return err
+		}
+	}
+
+	if ep.ForwardAgent {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			return err
+		}
+	}
+
+	prefix, err := taskPrefix(task, host, hosts)
+	if err != nil {
+		return err
+	}
+
+	// see https://github.com/kohkimakimoto/essh/issues/38
+	// the session waits for closing stdin, so it always uses a pipe.
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if stdinCh == nil {
+		stdin.Close()
+	} else {
+		go handleInput(stdinCh, stdin)
+	}
+
+	var flush func()
+	session.Stdout, session.Stderr, flush = setupOutput(task, host, hosts, prefix, m, r)
+	defer flush()
+
+	if debugFlag {
+		fmt.Printf("[essh debug] native command on %s: %s \n", ep, nativeCommand(c.Script))
+	}
+
+	return runNativeSession(ctx, session, nativeCommand(c.Script))
+}
+
+// runNativeCommand runs the command on the host with the streams by the native transport.
+func runNativeCommand(ctx context.Context, host *Host, command string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	session, _, err := newNativeSession(ctx, host)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	return runNativeSession(ctx, session, command)
+}
+
+// newNativeSession opens a session on the connection to the host.
+func newNativeSession(ctx context.Context, host *Host) (*ssh.Session, *nativeEndpoint, error) {
+	ep, err := newNativeEndpoint(host.Name)
+	if err != nil {
+		return nil, nil, &NativeConnectionError{Host: host.Name, Err: err}
+	}
+
+	client, err := nativeClients.get(ctx, ep)
+	if err != nil {
+		return nil, nil, &NativeConnectionError{Host: host.Name, Err: err}
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		// the connection may be closed by the server. connect again at the next time.
+		// a live connection is kept, because the other sessions may be running on it.
+		if !isNativeClientAlive(client, ep.ConnectTimeout) {
+			nativeClients.remove(ep, client)
+		}
+		return nil, nil, &NativeConnectionError{Host: host.Name, Err: err}
+	}
+
+	return session, ep, nil
+}
+
+// runNativeSession runs the command in the session, and kills it when the context is done.
+func runNativeSession(ctx context.Context, session *ssh.Session, command string) error {
+	if err := session.Start(command); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		select {
+		case <-done:
+		case <-time.After(killWaitDelay):
+		}
+		return ctx.Err()
+	}
+}
+
+// nativeEndpoint is a destination of the native transport that is resolved from the host's ssh config.
+type nativeEndpoint struct {
+	Name                  string
+	User                  string
+	Addr                  string
+	IdentityFiles         []string
+	ProxyJump             string
+	ForwardAgent          bool
+	StrictHostKeyChecking string
+	UserKnownHostsFile    string
+	ConnectTimeout        time.Duration
+}
+
+// newNativeEndpoint resolves the endpoint from a host name or a destination of ProxyJump like "user@host:port".
+// If the host part is a defined host, its ssh config is used.
+func newNativeEndpoint(dest string) (*nativeEndpoint, error) {
+	name, username, port := dest, "", ""
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		username, name = name[:i], name[i+1:]
+	}
+	if h, p, err := net.SplitHostPort(name); err == nil {
+		name, port = h, p
+	}
+
+	config := effectiveSSHConfig(name)
+
+	ep := &nativeEndpoint{
+		Name:                  name,
+		IdentityFiles:         effectiveSSHConfigValues(name, "IdentityFile"),
+		ProxyJump:             sshConfigValue(config, "ProxyJump"),
+		ForwardAgent:          strings.EqualFold(sshConfigValue(config, "ForwardAgent"), "yes"),
+		StrictHostKeyChecking: sshConfigValue(config, "StrictHostKeyChecking"),
+		UserKnownHostsFile:    sshConfigValue(config, "UserKnownHostsFile"),
+		ConnectTimeout:        defaultNativeConnectTimeout,
+	}
+
+	hostname := sshConfigValue(config, "HostName")
+	if hostname == "" {
+		hostname = name
+	}
+
+	if port == "" {
+		port = sshConfigValue(config, "Port")
+	}
+	if port == "" {
+		port = "22"
+	}
+	ep.Addr = net.JoinHostPort(hostname, port)
+
+	if username == "" {
+		username = sshConfigValue(config, "User")
+	}
+	if username == "" {
+		u, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		username = u.Username
+	}
+	ep.User = username
+
+	if v := sshConfigValue(config, "ConnectTimeout"); v != "" {
+		sec, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ConnectTimeout '%s'", v)
+		}
+		ep.ConnectTimeout = time.Duration(sec) * time.Second
+	}
+
+	return ep, nil
+}
+
+func (ep *nativeEndpoint) String() string {
+	return ep.User + "@" + ep.Addr
+}
+
+// key identifies the connection to the endpoint including the jump hosts.
+func (ep *nativeEndpoint) key() string {
+	if ep.ProxyJump == "" || ep.ProxyJump == "none" {
+		return ep.String()
+	}
+
+	return ep.ProxyJump + ">" + ep.String()
+}
+
+// jumpEndpoint returns the endpoint of the last jump host, or nil if the endpoint doesn't use jump hosts.
+func (ep *nativeEndpoint) jumpEndpoint() (*nativeEndpoint, error) {
+	if ep.ProxyJump == "" || ep.ProxyJump == "none" {
+		return nil, nil
+	}
+
+	jumps := strings.Split(ep.ProxyJump, ",")
+	jump, err := newNativeEndpoint(strings.TrimSpace(jumps[len(jumps)-1]))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(jumps) > 1 {
+		// the last jump host is reached through the previous ones.
+		jump.ProxyJump = strings.Join(jumps[:len(jumps)-1], ",")
+	}
+
+	if jump.key() == ep.key() {
+		return nil, fmt.Errorf("ProxyJump of %s refers to itself", ep.Name)
+	}
+
+	return jump, nil
+}
+
+func (ep *nativeEndpoint) clientConfig() (*ssh.ClientConfig, error) {
+	hostKeyCallback, err := ep.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User:            ep.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(ep.signers)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         ep.ConnectTimeout,
+	}, nil
+}
+
+// signers returns the keys of the ssh agent and all the identity files.
+// The default identity files are used if the endpoint doesn't have IdentityFile.
+func (ep *nativeEndpoint) signers() ([]ssh.Signer, error) {
+	signers := []ssh.Signer{}
+
+	if a := sshAgent(); a != nil {
+		agentSigners, err := a.Signers()
+		if err == nil {
+			signers = append(signers, agentSigners...)
+		} else if debugFlag {
+			fmt.Printf("[essh debug] couldn't get keys from the ssh agent: %v\n", err)
+		}
+	}
+
+	files := []string{}
+	if len(ep.IdentityFiles) > 0 {
+		for _, file := range ep.IdentityFiles {
+			files = append(files, expandHomeDir(file))
+		}
+	} else {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			files = append(files, filepath.Join(userHomeDir(), ".ssh", name))
+		}
+	}
+
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			if len(ep.IdentityFiles) > 0 {
+				return nil, err
+			}
+			continue
+		}
+
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			// keys protected by passphrases must be added to the ssh agent.
+			if debugFlag {
+				fmt.Printf("[essh debug] couldn't use the key %s: %v\n", file, err)
+			}
+			continue
+		}
+		signers = append(signers, signer)
+	}
+
+	return signers, nil
+}
+
+func (ep *nativeEndpoint) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if strings.EqualFold(ep.StrictHostKeyChecking, "no") {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	files := []string{}
+	knownHostsFiles := strings.Fields(ep.UserKnownHostsFile)
+	if len(knownHostsFiles) == 0 {
+		knownHostsFiles = []string{filepath.Join(userHomeDir(), ".ssh", "known_hosts")}
+	}
+	for _, file := range knownHostsFiles {
+		file = expandHomeDir(file)
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("known hosts file is not found. add the host key to %s or set StrictHostKeyChecking to 'no'", strings.Join(knownHostsFiles, " "))
+	}
+
+	return knownhosts.New(files...)
+}
+
+// sshConfigValue gets the value from the ssh config. The keys are case insensitive like ssh_config.
+func sshConfigValue(config map[string]string, key string) string {
+	for k, v := range config {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+
+	return ""
+}
+
+func expandHomeDir(path string) string {
+	if path == "~" {
+		return userHomeDir()
+	} else if strings.HasPrefix(path, "~/") {
+		return filepath.Join(userHomeDir(), path[2:])
+	}
+
+	return path
+}
+
+var (
+	sshAgentOnce   sync.Once
+	sshAgentClient agent.ExtendedAgent
+)
+
+// sshAgent returns the client of the ssh agent of SSH_AUTH_SOCK, or nil if it is not available.
+func sshAgent() agent.ExtendedAgent {
+	sshAgentOnce.Do(func() {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return
+		}
+
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			if debugFlag {
+				fmt.Printf("[essh debug] couldn't connect to the ssh agent: %v\n", err)
+			}
+			return
+		}
+
+		sshAgentClient = agent.NewClient(conn)
+	})
+
+	return sshAgentClient
+}
+
+// nativeClientPool keeps the connections of the native transport to reuse them across the hosts and the tasks.
+type nativeClientPool struct {
+	mutex   *sync.Mutex
+	clients map[string]*nativeClient
+}
+
+type nativeClient struct {
+	once   sync.Once
+	client *ssh.Client
+	err    error
+}
+
+var nativeClients = newNativeClientPool()
+
+func newNativeClientPool() *nativeClientPool {
+	return &nativeClientPool{
+		mutex:   new(sync.Mutex),
+		clients: map[string]*nativeClient{},
+	}
+}
+
+// get returns the connection to the endpoint. It connects if there is not the connection yet.
+func (p *nativeClientPool) get(ctx context.Context, ep *nativeEndpoint) (*ssh.Client, error) {
+	key := ep.key()
+
+	p.mutex.Lock()
+	c, ok := p.clients[key]
+	if !ok {
+		c = &nativeClient{}
+		p.clients[key] = c
+	}
+	p.mutex.Unlock()
+
+	c.once.Do(func() {
+		c.client, c.err = p.dial(ctx, ep)
+	})
+
+	if c.err != nil {
+		// don't keep the error to connect again at the next time like retrying.
+		p.mutex.Lock()
+		if p.clients[key] == c {
+			delete(p.clients, key)
+		}
+		p.mutex.Unlock()
+
+		return nil, c.err
+	}
+
+	return c.client, nil
+}
+
+func (p *nativeClientPool) dial(ctx context.Context, ep *nativeEndpoint) (*ssh.Client, error) {
+	config, err := ep.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	jump, err := ep.jumpEndpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	if debugFlag {
+		fmt.Printf("[essh debug] native transport connects to %s\n", ep.key())
+	}
+
+	var conn net.Conn
+	if jump != nil {
+		jumpClient, err := p.get(ctx, jump)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't connect to the jump host %s: %v", jump, err)
+		}
+
+		conn, err = jumpClient.DialContext(ctx, "tcp", ep.Addr)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		dialer := &net.Dialer{Timeout: ep.ConnectTimeout}
+		conn, err = dialer.DialContext(ctx, "tcp", ep.Addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sshConn, chans, reqs, err := newNativeClientConn(ctx, conn, ep.Addr, config, ep.ConnectTimeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	client := ssh.NewClient(sshConn, chans, reqs)
+	if ep.ForwardAgent {
+		if a := sshAgent(); a != nil {
+			if err := agent.ForwardToAgent(client, a); err != nil {
+				client.Close()
+				return nil, err
+			}
+		}
+	}
+
+	return client, nil
+}
+
+// newNativeClientConn runs the handshake on the conn within the timeout.
+// The conn through a jump host doesn't support deadlines, so the conn is closed to stop the handshake when the timeout expires.
+func newNativeClientConn(ctx context.Context, conn net.Conn, addr string, config *ssh.ClientConfig, timeout time.Duration) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err == nil {
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	type handshake struct {
+		conn  ssh.Conn
+		chans <-chan ssh.NewChannel
+		reqs  <-chan *ssh.Request
+		err   error
+	}
+
+	done := make(chan *handshake, 1)
+	go func() {
+		c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+		done <- &handshake{conn: c, chans: chans, reqs: reqs, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case h := <-done:
+		return h.conn, h.chans, h.reqs, h.err
+	case <-timer.C:
+		conn.Close()
+		<-done
+		return nil, nil, nil, fmt.Errorf("ssh handshake with %s timed out after %v", addr, timeout)
+	case <-ctx.Done():
+		conn.Close()
+		<-done
+		return nil, nil, nil, ctx.Err()
+	}
+}
+
+// isNativeClientAlive sends a keepalive request to check whether the connection is still alive.
+func isNativeClientAlive(client *ssh.Client, timeout time.Duration) bool {
+	alive := make(chan bool, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		alive <- err == nil
+	}()
+
+	select {
+	case ok := <-alive:
+		return ok
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// remove closes the client and removes it from the pool if it is still the pooled connection to the endpoint.
+func (p *nativeClientPool) remove(ep *nativeEndpoint, client *ssh.Client) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if c, ok := p.clients[ep.key()]; ok && c.client == client {
+		c.client.Close()
+		delete(p.clients, ep.key())
+	}
+}
+
+// closeAll closes all the connections.
+func (p *nativeClientPool) closeAll() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for key, c := range p.clients {
+		if c.client != nil {
+			c.client.Close()
+		}
+		delete(p.clients, key)
+	}
+}
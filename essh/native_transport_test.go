@@ -0,0 +1,378 @@
+package essh
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHServer is an in-process ssh server that runs the exec requests by sh.
+type testSSHServer struct {
+	addr    string
+	hostKey ssh.Signer
+	signals chan string
+}
+
+func newTestSSHServer(t *testing.T, authorizedKey ssh.PublicKey) *testSSHServer {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorizedKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unauthorized key")
+		},
+	}
+	hostKey := newTestSigner(t)
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := &testSSHServer{addr: listener.Addr().String(), hostKey: hostKey, signals: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+
+	return s
+}
+
+func (s *testSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		ch, reqs, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go s.serveSession(ch, reqs)
+	}
+}
+
+func (s *testSSHServer) serveSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+
+	var cmd *exec.Cmd
+	var mutex sync.Mutex
+	kill := func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if cmd != nil && cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+	}
+	defer kill()
+
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+
+			mutex.Lock()
+			cmd = exec.Command("sh", "-c", payload.Command)
+			cmd.Stdout = ch
+			cmd.Stderr = ch.Stderr()
+			err := cmd.Start()
+			mutex.Unlock()
+
+			go func() {
+				status := 127
+				if err == nil {
+					status = 0
+					if err := cmd.Wait(); err != nil {
+						status = 255
+						var exitErr *exec.ExitError
+						if errors.As(err, &exitErr) && exitErr.ExitCode() >= 0 {
+							status = exitErr.ExitCode()
+						}
+					}
+				}
+				ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+				ch.Close()
+			}()
+		case "signal":
+			var payload struct{ Signal string }
+			ssh.Unmarshal(req.Payload, &payload)
+			s.signals <- payload.Signal
+			kill()
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+// writeTestIdentityFile writes a new private key and returns the path and the signer of it.
+func writeTestIdentityFile(t *testing.T, dir string, name string) (string, ssh.Signer) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path, signer
+}
+
+func writeTestKnownHosts(t *testing.T, path string, addr string, key ssh.PublicKey) string {
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, key) + "\n"
+	if err := os.WriteFile(path, []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// setTestNativeHosts registers the hosts, and closes the connections of the native transport after the test.
+func setTestNativeHosts(t *testing.T, hosts ...*Host) {
+	saved := Hosts
+	Hosts = map[string]*Host{}
+	for _, host := range hosts {
+		Hosts[host.Name] = host
+	}
+	t.Cleanup(func() {
+		nativeClients.closeAll()
+		Hosts = saved
+	})
+}
+
+// newTestNativeTarget starts a server and returns the host that connects to it with the key and the known hosts file.
+func newTestNativeTarget(t *testing.T) (*testSSHServer, *Host) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	dir := t.TempDir()
+	keyFile, signer := writeTestIdentityFile(t, dir, "id_test")
+	s := newTestSSHServer(t, signer.PublicKey())
+
+	host := newTestHost("target", nil, nil)
+	hostname, port, _ := net.SplitHostPort(s.addr)
+	host.SSHConfig = map[string]string{
+		"HostName":           hostname,
+		"Port":               port,
+		"User":               "essh",
+		"IdentityFile":       keyFile,
+		"UserKnownHostsFile": writeTestKnownHosts(t, filepath.Join(dir, "known_hosts"), s.addr, s.hostKey.PublicKey()),
+	}
+
+	return s, host
+}
+
+func TestNativeTransportExitCode(t *testing.T) {
+	_, host := newTestNativeTarget(t)
+	setTestNativeHosts(t, host)
+
+	cases := []struct {
+		command  string
+		stdout   string
+		exitCode int
+	}{
+		{command: "echo hello", stdout: "hello\n", exitCode: 0},
+		{command: "exit 3", exitCode: 3},
+		{command: "echo failed; exit 1", stdout: "failed\n", exitCode: 1},
+		{command: "exit 255", exitCode: 255},
+	}
+
+	for _, c := range cases {
+		stdout := &bytes.Buffer{}
+		err := runNativeCommand(context.Background(), host, c.command, nil, stdout, &bytes.Buffer{})
+		if c.exitCode == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", c.command, err)
+			}
+		} else if code, ok := nativeExitCode(err); !ok || code != c.exitCode {
+			t.Errorf("%s: expected the exit code %d, but got %d (%v)", c.command, c.exitCode, code, err)
+		}
+		if stdout.String() != c.stdout {
+			t.Errorf("%s: expected the output '%s', but got '%s'", c.command, c.stdout, stdout.String())
+		}
+	}
+}
+
+func TestNativeTransportKillsSessionOnTimeout(t *testing.T) {
+	s, host := newTestNativeTarget(t)
+	setTestNativeHosts(t, host)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := runNativeCommand(ctx, host, "exec sleep 10", nil, &bytes.Buffer{}, &bytes.Buffer{})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %v, but got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond+killWaitDelay+time.Second {
+		t.Errorf("the session must be killed at the timeout, but it took %v", elapsed)
+	}
+
+	select {
+	case sig := <-s.signals:
+		if sig != string(ssh.SIGKILL) {
+			t.Errorf("expected the signal %s, but got %s", ssh.SIGKILL, sig)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the server didn't receive the signal to kill the session")
+	}
+}
+
+func TestNativeTransportHostKey(t *testing.T) {
+	s, host := newTestNativeTarget(t)
+	setTestNativeHosts(t, host)
+
+	dir := t.TempDir()
+	otherKey := newTestSigner(t).PublicKey()
+	cases := []struct {
+		desc                  string
+		knownHostsFile        string
+		strictHostKeyChecking string
+		fails                 bool
+		keyErr                bool
+		mismatched            bool
+	}{
+		{desc: "known", knownHostsFile: host.SSHConfig["UserKnownHostsFile"]},
+		{desc: "unknown", knownHostsFile: writeTestKnownHosts(t, filepath.Join(dir, "unknown"), "127.0.0.1:1", s.hostKey.PublicKey()), fails: true, keyErr: true},
+		{desc: "mismatched", knownHostsFile: writeTestKnownHosts(t, filepath.Join(dir, "mismatched"), s.addr, otherKey), fails: true, keyErr: true, mismatched: true},
+		{desc: "not checked", knownHostsFile: filepath.Join(dir, "mismatched"), strictHostKeyChecking: "no"},
+		{desc: "no known hosts file", knownHostsFile: filepath.Join(dir, "none"), fails: true},
+	}
+
+	for _, c := range cases {
+		nativeClients.closeAll()
+		host.SSHConfig["UserKnownHostsFile"] = c.knownHostsFile
+		host.SSHConfig["StrictHostKeyChecking"] = c.strictHostKeyChecking
+
+		err := runNativeCommand(context.Background(), host, "true", nil, &bytes.Buffer{}, &bytes.Buffer{})
+		if !c.fails {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", c.desc, err)
+			}
+			continue
+		}
+
+		if code, ok := nativeExitCode(err); !ok || code != 255 {
+			t.Errorf("%s: expected the exit code 255, but got %d (%v)", c.desc, code, err)
+		}
+		var keyErr *knownhosts.KeyError
+		if c.keyErr && !errors.As(err, &keyErr) {
+			t.Errorf("%s: expected a host key error, but got %v", c.desc, err)
+		} else if c.keyErr && (len(keyErr.Want) > 0) != c.mismatched {
+			t.Errorf("%s: expected the mismatched key %v, but got %v", c.desc, c.mismatched, keyErr.Want)
+		}
+	}
+}
+
+func TestNativeTransportIdentityFiles(t *testing.T) {
+	_, host := newTestNativeTarget(t)
+	keyFile := host.SSHConfig["IdentityFile"]
+	otherKeyFile, _ := writeTestIdentityFile(t, t.TempDir(), "id_other")
+
+	pattern := newTestHost("*", nil, nil)
+	setTestNativeHosts(t, host, pattern)
+
+	cases := []struct {
+		desc     string
+		values   []string
+		defaults []string
+		ok       bool
+	}{
+		{desc: "the key", values: []string{keyFile}, ok: true},
+		{desc: "the other key", values: []string{otherKeyFile}, ok: false},
+		{desc: "the second value", values: []string{otherKeyFile, keyFile}, ok: true},
+		{desc: "the pattern host", values: []string{otherKeyFile}, defaults: []string{keyFile}, ok: true},
+	}
+
+	for _, c := range cases {
+		nativeClients.closeAll()
+		host.SSHConfig["IdentityFile"] = c.values[0]
+		host.SSHConfigValues = map[string][]string{"IdentityFile": c.values}
+		delete(pattern.SSHConfig, "IdentityFile")
+		pattern.SSHConfigValues = map[string][]string{}
+		if c.defaults != nil {
+			pattern.SSHConfig["IdentityFile"] = c.defaults[0]
+			pattern.SSHConfigValues["IdentityFile"] = c.defaults
+		}
+
+		err := runNativeCommand(context.Background(), host, "true", nil, &bytes.Buffer{}, &bytes.Buffer{})
+		if c.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", c.desc, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("%s: expected an authentication error, but got nil", c.desc)
+		}
+	}
+}
+
+func TestNativeTransportRejectsSSHOptions(t *testing.T) {
+	_, host := newTestNativeTarget(t)
+	setTestNativeHosts(t, host)
+
+	task := NewTask()
+	task.Name = "deploy"
+	task.Transport = TRANSPORT_NATIVE
+	task.SSHOptions = []string{"-o", "Compression=yes"}
+
+	err := runNativeTaskScript(context.Background(), "", task, host, []*Host{host}, nil, new(sync.Mutex), &HostResult{})
+	if err == nil || !strings.Contains(err.Error(), "ssh_options") {
+		t.Errorf("expected the error of ssh_options, but got %v", err)
+	}
+
+	if err := runFileTransferCommand(context.Background(), "", task, host, "true", nil, &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "ssh_options") {
+		t.Errorf("expected the error of ssh_options, but got %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+package essh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sevir/essh/support/color"
+)
+
+// outputMutex prevents mixing output events of concurrent hosts and tasks in a line.
+var outputMutex = new(sync.Mutex)
+
+// outputMode returns the output mode of the task. The --output option overrides the task's output.
+func outputMode(task *Task) string {
+	if outputVar != "" {
+		return outputVar
+	}
+
+	return task.Output
+}
+
+// groupOutput returns true if the outputs of the hosts are grouped. The --group-output option enables it for every task.
+func groupOutput(task *Task) bool {
+	return (groupOutputFlag || task.GroupOutput) && outputMode(task) == TASK_OUTPUT_TEXT
+}
+
+// maxCapturedOutput is the max size of each output stream of a host kept in the result for the task's callbacks.
+const maxCapturedOutput = 1024 * 1024
+
+// maxRecordedOutput is the max size of each output stream of a host kept only to record it in the run history.
+const maxRecordedOutput = 64 * 1024
+
+// outputCaptureLimit returns the max size of each output stream of a host kept in the result.
+// The outputs are used by the task's callbacks only if the task captures them.
+// Otherwise only the run history uses them, so only the beginning of them is kept to save memory on many hosts.
+func outputCaptureLimit(task *Task) int {
+	if task.Capture {
+		return maxCapturedOutput
+	}
+
+	return maxRecordedOutput
+}
+
+// setupOutput returns writers for the command's stdout and stderr by the task's output mode, that capture the outputs to the result by outputCaptureLimit.
+// The returned function flushes the last lines, so call it after the command finished.
+func setupOutput(task *Task, host *Host, hosts []*Host, prefix string, m *sync.Mutex, r *HostResult) (io.Writer, io.Writer, func()) {
+	var stdout, stderr io.Writer
+	flush := func() {}
+
+	if outputMode(task) == TASK_OUTPUT_JSONL {
+		jsonStdout := newJSONLineWriter(task, host, "stdout")
+		jsonStderr := newJSONLineWriter(task, host, "stderr")
+		stdout, stderr = jsonStdout, jsonStderr
+		flush = func() {
+			jsonStdout.Flush()
+			jsonStderr.Flush()
+		}
+	} else if groupOutput(task) && host != nil {
+		// the outputs are printed by printGroupedOutputs after all hosts finished.
+		output := &lockedWriter{w: &captureWriter{dest: &r.Output, limit: maxCapturedOutput}, m: new(sync.Mutex)}
+		stdout, stderr = output, output
+	} else if len(hosts) <= 1 && prefix == "" {
+		if (task.Pty || !task.IsRemoteTask()) && !task.Capture {
+			// The command uses the terminal directly, because capturing the outputs changes its behavior.
+			return os.Stdout, os.Stderr, flush
+		}
+		stdout, stderr = os.Stdout, os.Stderr
+	} else {
+		lineStdout := newLineWriter(os.Stdout, prefix, m)
+		lineStderr := newLineWriter(os.Stderr, prefix, m)
+		stdout, stderr = lineStdout, lineStderr
+		flush = func() {
+			lineStdout.Flush()
+			lineStderr.Flush()
+		}
+	}
+
+	limit := outputCaptureLimit(task)
+	stdout = io.MultiWriter(stdout, &captureWriter{dest: &r.Stdout, limit: limit})
+	stderr = io.MultiWriter(stderr, &captureWriter{dest: &r.Stderr, limit: limit})
+
+	return stdout, stderr, flush
+}
+
+// captureWriter appends data to dest up to limit bytes and discards the rest.
+type captureWriter struct {
+	dest  *[]byte
+	limit int
+}
+
+func (w *captureWriter) Write(data []byte) (int, error) {
+	if room := w.limit - len(*w.dest); room > 0 {
+		if len(data) < room {
+			room = len(data)
+		}
+		*w.dest = append(*w.dest, data[:room]...)
+	}
+
+	return len(data), nil
+}
+
+// lockedWriter serializes writes of stdout and stderr to the same writer.
+type lockedWriter struct {
+	w io.Writer
+	m *sync.Mutex
+}
+
+func (w *lockedWriter) Write(data []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	return w.w.Write(data)
+}
+
+// printGroupedOutputs prints each distinct output once with the hosts that produced it like clubak.
+// Hosts that didn't output anything are not printed.
+func printGroupedOutputs(w io.Writer, results []*HostResult) {
+	outputs := []string{}
+	hostsByOutput := map[string][]string{}
+	for _, r := range results {
+		if len(r.Output) == 0 {
+			continue
+		}
+
+		output := string(r.Output)
+		if _, ok := hostsByOutput[output]; !ok {
+			outputs = append(outputs, output)
+		}
+		hostsByOutput[output] = append(hostsByOutput[output], r.HostName())
+	}
+
+	for _, output := range outputs {
+		hosts := hostsByOutput[output]
+		fmt.Fprint(w, color.FgCB("---------------\n%s (%d)\n---------------\n", strings.Join(hosts, ","), len(hosts)))
+		fmt.Fprint(w, output)
+		if !strings.HasSuffix(output, "\n") {
+			fmt.Fprint(w, "\n")
+		}
+	}
+}
+
+// lineWriter writes data line by line to prevent mixing outputs of multiple hosts in a line.
+// this code is based on scanLines borrowed from https://github.com/fujiwara/nssh/blob/master/nssh.go
+type lineWriter struct {
+	buf       []byte
+	writeLine func(line []byte)
+}
+
+func newLineWriter(dest io.Writer, prefix string, m *sync.Mutex) *lineWriter {
+	return &lineWriter{
+		writeLine: func(line []byte) {
+			m.Lock()
+			defer m.Unlock()
+			if prefix != "" {
+				fmt.Fprintf(dest, "%s%s\n", color.FgCB(prefix), line)
+			} else {
+				fmt.Fprintf(dest, "%s\n", line)
+			}
+		},
+	}
+}
+
+func newJSONLineWriter(task *Task, host *Host, stream string) *lineWriter {
+	return &lineWriter{
+		writeLine: func(line []byte) {
+			ev := newOutputEvent("output", task, host)
+			ev.Stream = stream
+			lineStr := string(line)
+			ev.Line = &lineStr
+			writeOutputEvent(ev)
+		},
+	}
+}
+
+func (w *lineWriter) Write(data []byte) (int, error) {
+	w.buf = append(w.buf, data...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.writeLine(bytes.TrimSuffix(w.buf[:i], []byte{'\r'}))
+		w.buf = w.buf[i+1:]
+	}
+
+	return len(data), nil
+}
+
+// Flush writes the last line that doesn't end with a newline.
+func (w *lineWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.writeLine(bytes.TrimSuffix(w.buf, []byte{'\r'}))
+		w.buf = nil
+	}
+}
+
+// OutputEvent is a line of the jsonl output.
+type OutputEvent struct {
+	Type      string    `json:"type"`
+	Task      string    `json:"task"`
+	Host      *string   `json:"host"`
+	Stream    string    `json:"stream,omitempty"`
+	Line      *string   `json:"line,omitempty"`
+	Status    string    `json:"status,omitempty"`
+	ExitCode  *int      `json:"exit_code,omitempty"`
+	Duration  *float64  `json:"duration,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func newOutputEvent(typ string, task *Task, host *Host) *OutputEvent {
+	ev := &OutputEvent{
+		Type:      typ,
+		Task:      task.Name,
+		Timestamp: time.Now(),
+	}
+	if host != nil {
+		ev.Host = &host.Name
+	}
+
+	return ev
+}
+
+func newStartEvent(task *Task, host *Host) *OutputEvent {
+	return newOutputEvent("start", task, host)
+}
+
+func newFinishEvent(task *Task, r *HostResult) *OutputEvent {
+	ev := newOutputEvent("finish", task, r.Host)
+	ev.Status = r.Status()
+	ev.ExitCode = &r.ExitCode
+	duration := r.Duration.Seconds()
+	ev.Duration = &duration
+	if r.Err != nil {
+		ev.Error = r.Err.Error()
+	}
+
+	return ev
+}
+
+func writeOutputEvent(ev *OutputEvent) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		fmt.Fprint(os.Stderr, color.FgRB("essh error: %v\n", err))
+		return
+	}
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	os.Stdout.Write(append(b, '\n'))
+}
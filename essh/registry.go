@@ -4,11 +4,13 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"github.com/yuin/gopher-lua"
+	"path/filepath"
 )
 
 type Registry struct {
-	Key  string
-	Type int
+	Key     string
+	Type    int
+	DataDir string
 }
 
 const (
@@ -20,15 +22,27 @@ var CurrentRegistry *Registry
 var GlobalRegistry *Registry
 var LocalRegistry *Registry
 
+// CurrentConfigFile is the config file that is being loaded.
+var CurrentConfigFile string
+
 func NewRegistry(dataDir string, registryType int) *Registry {
 	reg := &Registry{
-		Key:  fmt.Sprintf("%x", sha256.Sum256([]byte(dataDir))),
-		Type: registryType,
+		Key:     fmt.Sprintf("%x", sha256.Sum256([]byte(dataDir))),
+		Type:    registryType,
+		DataDir: dataDir,
 	}
 
 	return reg
 }
 
+func (reg *Registry) RunsDir() string {
+	return filepath.Join(reg.DataDir, "runs")
+}
+
+func (reg *Registry) InventoryDir() string {
+	return filepath.Join(reg.DataDir, "inventory")
+}
+
 //func (reg *Registry) PackagesDir() string {
 //	return filepath.Join(reg.DataDir, "packages")
 //}
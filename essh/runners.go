@@ -1,14 +1,19 @@
 package essh
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"text/template"
+	"time"
 
 	"github.com/Songmu/wrapcommander"
 	"github.com/sevir/essh/support/color"
@@ -16,6 +21,20 @@ import (
 )
 
 func runTask(config string, task *Task, args []string, L *lua.LState) error {
+	return newTaskScheduler(config, L).run(task, args)
+}
+
+// runTaskWithResults runs the task like runTask and returns the results of the task's script.
+// The outputs of the task are captured in the results even if the task doesn't capture them.
+func runTaskWithResults(config string, task *Task, args []string, L *lua.LState) ([]*HostResult, error) {
+	s := newTaskScheduler(config, L)
+	s.capture = true
+	err := s.run(task, args)
+
+	return s.runs[task.Name].results, err
+}
+
+func prepareTask(task *Task, args []string, L *lua.LState) error {
 	if debugFlag {
 		fmt.Printf("[essh debug] run task: %s\n", task.Name)
 		fmt.Printf("[essh debug] task's args: %v\n", args)
@@ -26,6 +45,21 @@ func runTask(config string, task *Task, args []string, L *lua.LState) error {
 		CurrentRegistry = task.Registry
 	}
 
+	task.RawArgs = args
+	if len(task.Params) > 0 {
+		values, rest, err := parseTaskParams(task, args)
+		if err != nil {
+			return err
+		}
+
+		valuestb := L.NewTable()
+		for name, value := range values {
+			valuestb.RawSetString(name, task.Param(name).toLValue(value))
+		}
+		updateTask(L, task, "param_values", valuestb)
+		args = rest
+	}
+
 	// compose args
 	argstb := L.NewTable()
 	for i := 0; i < len(args); i++ {
@@ -33,7 +67,9 @@ func runTask(config string, task *Task, args []string, L *lua.LState) error {
 	}
 	updateTask(L, task, "args", argstb)
 
-	if task.Prepare != nil {
+	if task.Prepare != nil && dryRunFlag && !withPrepareFlag {
+		fmt.Fprint(os.Stderr, color.FgYB("essh: skipped the prepare function of the task '%s' in dry-run mode.\n", task.Name))
+	} else if task.Prepare != nil {
 		if debugFlag {
 			fmt.Printf("[essh debug] run task's prepare function.\n")
 		}
@@ -44,255 +80,601 @@ func runTask(config string, task *Task, args []string, L *lua.LState) error {
 		}
 	}
 
+	if err := resolveTaskTargets(task, L); err != nil {
+		return err
+	}
+
+	return prepareTaskHosts(task, L)
+}
+
+// resolveTaskTargets evaluates the host query assigned to the task's targets again, because hosts may be defined or changed after the assignment.
+// It must be called in the goroutine that can use the lua state.
+func resolveTaskTargets(task *Task, L *lua.LState) error {
+	if task.TargetsQuery == nil {
+		return nil
+	}
+
+	var hosts []*Host
+	err := L.CallByParam(lua.P{
+		Fn: L.NewFunction(func(L *lua.LState) int {
+			hosts = task.TargetsQuery.GetHostsInOrder()
+			return 0
+		}),
+		NRet:    0,
+		Protect: true,
+	})
+	if err != nil {
+		return fmt.Errorf("task '%s' failed to evaluate the targets: %v", task.Name, err)
+	}
+	if len(hosts) == 0 {
+		return fmt.Errorf("task '%s' doesn't have hosts that match the targets.", task.Name)
+	}
+
+	task.TargetHosts = hosts
+	task.Targets = hostNames(hosts)
+	return nil
+}
+
+// prepareTaskHosts decides the hosts to run the task by the task's when, and resolves the environment variables for them.
+// Call it again if the targets of the task are changed.
+func prepareTaskHosts(task *Task, L *lua.LState) error {
+	if err := evaluateTaskWhen(task); err != nil {
+		return err
+	}
+
+	return resolveTaskEnv(task, L)
+}
+
+// evaluateTaskWhen calls the task's when for each target host, and keeps the hosts it excluded to skip them.
+// It must be called in the goroutine that can use the lua state.
+func evaluateTaskWhen(task *Task) error {
+	task.SkippedHosts = []*Host{}
+	if task.When == nil {
+		return nil
+	}
+
+	for _, host := range selectTaskHosts(task) {
+		ok, err := task.When(host)
+		if err != nil {
+			return fmt.Errorf("task '%s' failed to evaluate 'when' for the host '%s': %v", task.Name, host.Name, err)
+		}
+		if !ok {
+			task.SkippedHosts = append(task.SkippedHosts, host)
+		}
+	}
+
+	if debugFlag {
+		fmt.Printf("[essh debug] skipped hosts by 'when': %d\n", len(task.SkippedHosts))
+	}
+
+	return nil
+}
+
+// finishTask calls the task's callbacks with the results of running the script.
+func finishTask(task *Task, results []*HostResult, err error) error {
+	if task.OnSuccess == nil && task.OnFailure == nil && task.Finally == nil {
+		return err
+	}
+
+	if dryRunFlag {
+		fmt.Fprint(os.Stderr, color.FgYB("essh: skipped the callbacks of the task '%s' in dry-run mode.\n", task.Name))
+		return err
+	}
+
+	if debugFlag {
+		fmt.Printf("[essh debug] run task's callbacks.\n")
+	}
+
+	if err == nil && task.OnSuccess != nil {
+		err = task.OnSuccess(results, nil)
+	} else if err != nil && task.OnFailure != nil {
+		if cerr := task.OnFailure(results, err); cerr != nil {
+			fmt.Fprint(os.Stderr, color.FgRB("essh error: %v\n", cerr))
+		}
+	}
+
+	if task.Finally != nil {
+		if cerr := task.Finally(results, err); cerr != nil {
+			if err == nil {
+				err = cerr
+			} else {
+				fmt.Fprint(os.Stderr, color.FgRB("essh error: %v\n", cerr))
+			}
+		}
+	}
+
+	return err
+}
+
+// runTaskScripts runs the task's script on the target hosts. The hosts read stdin only if stdin is true.
+func runTaskScripts(config string, task *Task, stdin bool) (results []*HostResult, err error) {
+	if dryRunFlag {
+		return nil, dryRunTaskScripts(os.Stdout, config, task)
+	}
+
+	record := newRunRecord(task)
+	defer func() {
+		record.finish(results, err)
+		if err := saveRunRecord(record); err != nil {
+			fmt.Fprint(os.Stderr, color.FgYB("essh warning: couldn't save the run to the history: %v\n", err))
+		}
+	}()
+
+	ctx, cancel := withTimeout(context.Background(), taskTimeout(task))
+	defer cancel()
+
 	// get target hosts.
 	if task.IsRemoteTask() {
 		// run remotely.
-		var hosts []*Host
-		if len(task.TargetsSlice()) == 0 {
-			hosts = []*Host{}
-		} else {
-			hosts = NewHostQuery().
-				AppendSelections(task.TargetsSlice()).
-				AppendFilters(task.FiltersSlice()).
-				GetHostsOrderByName()
+		hosts := selectTaskHosts(task)
+
+		if len(hosts) == 0 && len(task.SkippedHosts) > 0 {
+			return skipHosts(task), nil
 		}
 
 		if len(hosts) == 0 {
-			return fmt.Errorf("There are not hosts to run the command. you must specify the valid hosts.")
+			return nil, fmt.Errorf("There are not hosts to run the command. you must specify the valid hosts.")
 		}
 
 		// see https://github.com/kohkimakimoto/essh/issues/38
 		//// handle stdin
-		stdinChs := make([]chan ([]byte), len(hosts))
-		for i, _ := range hosts {
-			stdinChs[i] = make(chan []byte, 256)
-		}
-		go func() {
-			processStdin(stdinChs)
-		}()
+		stdinChs := newStdinChannels(len(hosts), stdin)
 
-		wg := &sync.WaitGroup{}
 		m := new(sync.Mutex)
-		for i, host := range hosts {
-			if task.Parallel {
-				wg.Add(1)
-				go func(host *Host) {
-					err := runRemoteTaskScript(config, task, host, hosts, stdinChs[i], m)
-					if err != nil {
-						fmt.Fprintf(os.Stderr, color.FgRB("essh error: %v\n", err))
-						panic(err)
-					}
-
-					wg.Done()
-				}(host)
-			} else {
-				err := runRemoteTaskScript(config, task, host, hosts, stdinChs[i], m)
-				if err != nil {
-					return err
+		return runHosts(ctx, task, hosts, func(ctx context.Context, i int, r *HostResult) error {
+			return runWithFileTransfers(ctx, config, task, r.Host, func() error {
+				if taskTransport(task, r.Host) == TRANSPORT_NATIVE {
+					return runNativeTaskScript(ctx, config, task, r.Host, hosts, stdinChs[i], m, r)
 				}
-			}
-		}
-		wg.Wait()
+				return runRemoteTaskScript(ctx, config, task, r.Host, hosts, stdinChs[i], m, r)
+			})
+		})
 	} else {
 		// run locally.
-		var hosts []*Host
-		if len(task.TargetsSlice()) == 0 {
-			hosts = []*Host{}
-		} else {
-			hosts = NewHostQuery().
-				AppendSelections(task.TargetsSlice()).
-				AppendFilters(task.FiltersSlice()).
-				GetHostsOrderByName()
+		hosts := selectTaskHosts(task)
+
+		if len(hosts) == 0 && len(task.SkippedHosts) > 0 {
+			return skipHosts(task), nil
 		}
 
 		if len(task.Targets) >= 1 && len(hosts) == 0 {
-			return fmt.Errorf("There are not hosts to run the command. you must specify the valid hosts.")
+			return nil, fmt.Errorf("There are not hosts to run the command. you must specify the valid hosts.")
 		}
 
-		wg := &sync.WaitGroup{}
 		m := new(sync.Mutex)
 
+		if len(hosts) == 0 && (len(task.Upload) > 0 || len(task.Download) > 0) {
+			return nil, fmt.Errorf("task '%s' has upload or download, but it doesn't have target hosts.", task.Name)
+		}
+
 		if len(hosts) == 0 {
 			// local no host task
 			// This pattern should run just exec. should not use magic to pipe stdin to multi targets.
-			err := runLocalTaskScript(config, task, nil, hosts, nil, m)
-			if err != nil {
-				return err
+			var stdinCh chan []byte
+			if !stdin {
+				stdinCh = newStdinChannels(1, false)[0]
 			}
-			return nil
+			results = []*HostResult{
+				runTaskOnHost(ctx, task, nil, func(ctx context.Context, r *HostResult) error {
+					return runLocalTaskScript(ctx, config, task, nil, hosts, stdinCh, m, r)
+				}),
+			}
+			return results, checkHostResults(task, results)
 		}
 
 		// see https://github.com/kohkimakimoto/essh/issues/38
 		// handle stdin
-		stdinChs := make([]chan ([]byte), len(hosts))
-		for i, _ := range hosts {
-			stdinChs[i] = make(chan []byte, 256)
+		stdinChs := newStdinChannels(len(hosts), stdin)
+
+		return runHosts(ctx, task, hosts, func(ctx context.Context, i int, r *HostResult) error {
+			return runWithFileTransfers(ctx, config, task, r.Host, func() error {
+				return runLocalTaskScript(ctx, config, task, r.Host, hosts, stdinChs[i], m, r)
+			})
+		})
+	}
+}
+
+// newStdinChannels returns the channels that pass stdin to the hosts' processes.
+// If stdin isn't used, the channels are closed and the processes read EOF.
+func newStdinChannels(n int, stdin bool) []chan []byte {
+	stdinChs := make([]chan ([]byte), n)
+	for i := range stdinChs {
+		stdinChs[i] = make(chan []byte, 256)
+		if !stdin {
+			close(stdinChs[i])
 		}
+	}
+
+	if stdin {
 		go func() {
 			processStdin(stdinChs)
 		}()
+	}
 
-		for i, host := range hosts {
-			if task.Parallel {
-				wg.Add(1)
-				go func(host *Host) {
-					err := runLocalTaskScript(config, task, host, hosts, stdinChs[i], m)
-					if err != nil {
-						fmt.Fprintf(os.Stderr, color.FgRB("essh error: %v\n", err))
-						panic(err)
-					}
-
-					wg.Done()
-				}(host)
-			} else {
-				err := runLocalTaskScript(config, task, host, hosts, stdinChs[i], m)
-				if err != nil {
-					return err
-				}
-			}
+	return stdinChs
+}
+
+// selectTaskHosts returns the task's target hosts except the hosts skipped by the task's when.
+func selectTaskHosts(task *Task) []*Host {
+	if len(task.TargetsSlice()) == 0 {
+		return []*Host{}
+	}
+
+	var hosts []*Host
+	if task.TargetHosts != nil {
+		// keep the order of the host query assigned to the targets.
+		hostQuery := NewHostQuery()
+		hosts = task.TargetHosts
+		for _, filter := range compileSelectors(task.FiltersSlice()) {
+			hosts = hostQuery.filterHosts(hosts, filter)
 		}
-		wg.Wait()
+	} else {
+		hosts = NewHostQuery().
+			AppendSelections(task.TargetsSlice()).
+			AppendFilters(task.FiltersSlice()).
+			GetHostsOrderByName()
 	}
 
-	return nil
+	if len(task.SkippedHosts) == 0 {
+		return hosts
+	}
+
+	skipped := map[*Host]bool{}
+	for _, host := range task.SkippedHosts {
+		skipped[host] = true
+	}
+
+	newHosts := []*Host{}
+	for _, host := range hosts {
+		if !skipped[host] {
+			newHosts = append(newHosts, host)
+		}
+	}
+
+	return newHosts
 }
 
-func runRemoteTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*Host, stdinCh chan []byte, m *sync.Mutex) error {
-	// setup ssh command args
-	var sshCommandArgs []string
-	if task.Pty {
-		sshCommandArgs = []string{"-t", "-t", "-F", sshConfigPath, host.Name}
-	} else {
-		sshCommandArgs = []string{"-F", sshConfigPath, host.Name}
+// skipHosts reports the hosts skipped by the task's when and returns their results.
+func skipHosts(task *Task) []*HostResult {
+	results := []*HostResult{}
+	for _, host := range task.SkippedHosts {
+		r := &HostResult{Host: host, Skipped: true}
+		if outputMode(task) == TASK_OUTPUT_JSONL {
+			writeOutputEvent(newFinishEvent(task, r))
+		} else {
+			fmt.Fprint(os.Stderr, color.FgYB("essh: skipped the host '%s' by the task's when.\n", host.Name))
+		}
+		results = append(results, r)
 	}
 
-	// generate commands by using driver
-	if task.Driver == "" {
-		task.Driver = DefaultDriverName
+	return results
+}
+
+// taskTimeout returns the timeout of the whole task. The --timeout option overrides the task's timeout.
+func taskTimeout(task *Task) time.Duration {
+	if timeoutVar > 0 {
+		return timeoutVar
 	}
 
-	driver := Drivers[task.Driver]
-	if driver == nil {
-		return fmt.Errorf("invalid driver name '%s'", task.Driver)
+	return task.Timeout
+}
+
+// hostTimeout returns the timeout for each host. The --host-timeout option overrides the task's host_timeout.
+func hostTimeout(task *Task) time.Duration {
+	if hostTimeoutVar > 0 {
+		return hostTimeoutVar
 	}
 
-	if debugFlag {
-		fmt.Printf("[essh debug] driver: %s \n", driver.Name)
+	return task.HostTimeout
+}
+
+// withTimeout returns a context that is canceled after the timeout. Zero timeout means no limit.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
 	}
 
-	var script string
-	content, err := driver.GenerateRunnableContent(sshConfigPath, task, host)
-	if err != nil {
-		return err
+	return context.WithTimeout(ctx, timeout)
+}
+
+// runTaskOnHost calls fn with the task's timeout and retry policy, and reports the result.
+func runTaskOnHost(ctx context.Context, task *Task, host *Host, fn func(ctx context.Context, r *HostResult) error) *HostResult {
+	if outputMode(task) == TASK_OUTPUT_JSONL {
+		writeOutputEvent(newStartEvent(task, host))
 	}
-	script += content
 
-	if task.User != "" {
-		script = "sudo -u " + ShellEscape(task.User) + " bash -l -c " + ShellEscape(script)
-	} else if task.Privileged {
-		script = "sudo bash -l -c " + ShellEscape(script)
+	r := runHost(ctx, host, hostTimeout(task), func(ctx context.Context, r *HostResult) error {
+		return runWithRetry(ctx, task, host, func(ctx context.Context) error {
+			// keep only the outputs of the last attempt.
+			r.Stdout, r.Stderr = nil, nil
+			return fn(ctx, r)
+		})
+	})
+
+	if outputMode(task) == TASK_OUTPUT_JSONL {
+		writeOutputEvent(newFinishEvent(task, r))
 	}
 
-	sshCommandArgs = append(sshCommandArgs, "bash", "-c", ShellEscape(script))
+	return r
+}
 
-	if task.SSHOptions != nil {
-		sshCommandArgs = append(task.SSHOptions, sshCommandArgs[:]...)
+// runWithRetry calls fn until it succeeds or the task's retry policy gives up.
+func runWithRetry(ctx context.Context, task *Task, host *Host, fn func(ctx context.Context) error) error {
+	retry := task.Retry
+	if retry == nil {
+		return fn(ctx)
 	}
 
-	cmd := exec.Command("ssh", sshCommandArgs[:]...)
-	if debugFlag {
-		fmt.Printf("[essh debug] real ssh command: %v \n", cmd.Args)
+	hostname := "local"
+	if host != nil {
+		hostname = host.Name
 	}
 
-	prefix := ""
-	if task.UsePrefix {
-		prefixTmp := task.Prefix
-		if prefixTmp == "" {
-			if task.IsRemoteTask() {
-				prefixTmp = DefaultPrefixRemote
-			} else {
-				prefixTmp = DefaultPrefixLocal
+	delay := retry.Delay
+	if delay > retry.MaxDelay {
+		delay = retry.MaxDelay
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt >= retry.Attempts || ctx.Err() != nil {
+			return err
+		}
+
+		if code := resolveExitCode(err); !retry.IsRetryableExitCode(code) {
+			return err
+		}
+
+		fmt.Fprint(os.Stderr, color.FgYB("essh warning: %s failed on %s (%v). retrying in %v (%d/%d)\n", task.Name, hostname, err, delay, attempt+1, retry.Attempts))
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+
+		delay = retry.NextDelay(delay)
+	}
+}
+
+// runHosts calls fn for each host and collects the results.
+// Hosts are split into batches by the task's serial setting, and each batch runs after the previous one finished.
+// When a host fails, the hosts that have not started yet are aborted unless the task continues on error.
+func runHosts(ctx context.Context, task *Task, hosts []*Host, fn func(ctx context.Context, i int, r *HostResult) error) ([]*HostResult, error) {
+	skippedResults := skipHosts(task)
+	results := make([]*HostResult, len(hosts))
+	aborted := &atomic.Bool{}
+	// stopped is the error that stopped running the next batches.
+	var stopped error
+
+	batches := splitBatches(len(hosts), task.BatchSizes(len(hosts)))
+	for b, batch := range batches {
+		if b > 0 {
+			if err := pauseBatch(ctx, task); err != nil {
+				stopped = err
+				break
 			}
 		}
 
-		funcMap := template.FuncMap{
-			"ShellEscape":         ShellEscape,
-			"ToUpper":             strings.ToUpper,
-			"ToLower":             strings.ToLower,
-			"EnvKeyEscape":        EnvKeyEscape,
-			"HostnameAlignString": HostnameAlignString(host, hosts),
+		if debugFlag {
+			fmt.Printf("[essh debug] run batch %d/%d (%d hosts)\n", b+1, len(batches), len(batch))
 		}
 
-		dict := map[string]interface{}{
-			"Host": host,
-			"Task": task,
+		runBatch(ctx, task, hosts, batch, results, aborted, fn)
+		if aborted.Load() {
+			break
 		}
-		tmpl, err := template.New("T").Funcs(funcMap).Parse(prefixTmp)
-		if err != nil {
-			return err
+
+		if task.MaxFailPercentage != nil {
+			failed := 0
+			for _, i := range batch {
+				if results[i].Failed() {
+					failed++
+				}
+			}
+
+			percentage := float64(failed) / float64(len(batch)) * 100
+			if percentage > *task.MaxFailPercentage {
+				fmt.Fprint(os.Stderr, color.FgRB("essh error: %.0f%% of hosts failed in batch %d/%d. it exceeds max_fail_percentage %v%%.\n", percentage, b+1, len(batches), *task.MaxFailPercentage))
+				break
+			}
 		}
-		var b bytes.Buffer
-		err = tmpl.Execute(&b, dict)
-		if err != nil {
-			return err
+	}
+
+	for i, host := range hosts {
+		if results[i] == nil {
+			results[i] = &HostResult{Host: host, Aborted: true}
 		}
+	}
 
-		prefix = b.String()
+	if len(skippedResults) > 0 {
+		results = append(results, skippedResults...)
+		sort.SliceStable(results, func(i, j int) bool {
+			return results[i].HostName() < results[j].HostName()
+		})
 	}
 
-	// cmd.Stdin = os.Stdin
+	if groupOutput(task) {
+		printGroupedOutputs(os.Stdout, results)
+	}
 
-	// see https://github.com/kohkimakimoto/essh/issues/38
-	if stdinCh == nil {
-		cmd.Stdin = os.Stdin
-	} else {
-		stdin, err := cmd.StdinPipe()
-		if err != nil {
-			return err
+	if len(results) > 1 && outputMode(task) == TASK_OUTPUT_TEXT {
+		printHostResults(os.Stderr, results)
+	}
+
+	if stopped != nil {
+		return results, &TaskError{Task: task, Results: results, Stopped: stopped}
+	}
+
+	return results, checkHostResults(task, results)
+}
+
+// runBatch calls fn for the hosts at the indexes.
+// If the task runs in parallel, fn is called by a pool of workers that limits the number of concurrent hosts.
+// A failed host doesn't abort the batch if the task has max_fail_percentage, because the percentage decides to stop.
+func runBatch(ctx context.Context, task *Task, hosts []*Host, indexes []int, results []*HostResult, aborted *atomic.Bool, fn func(ctx context.Context, i int, r *HostResult) error) {
+	continueOnError := continueOnErrorFlag || task.OnError == TASK_ON_ERROR_CONTINUE || task.MaxFailPercentage != nil
+
+	run := func(i int) {
+		results[i] = runTaskOnHost(ctx, task, hosts[i], func(ctx context.Context, r *HostResult) error {
+			return fn(ctx, i, r)
+		})
+		if results[i].Failed() && !continueOnError {
+			aborted.Store(true)
 		}
-		go handleInput(stdinCh, stdin)
 	}
 
-	wg := &sync.WaitGroup{}
-	if len(hosts) <= 1 && prefix == "" {
-		cmd.Stdout = os.Stdout
-	} else {
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			return err
+	if !task.Parallel {
+		for _, i := range indexes {
+			if aborted.Load() {
+				break
+			}
+			run(i)
 		}
+		return
+	}
+
+	limit := task.MaxParallel
+	if parallelLimitVar > 0 {
+		limit = parallelLimitVar
+	}
+	if limit <= 0 || limit > len(indexes) {
+		limit = len(indexes)
+	}
+
+	if debugFlag {
+		fmt.Printf("[essh debug] run %d hosts with %d workers\n", len(indexes), limit)
+	}
+
+	queue := make(chan int)
+	wg := &sync.WaitGroup{}
+	for w := 0; w < limit; w++ {
 		wg.Add(1)
 		go func() {
-			scanLines(stdout, os.Stdout, prefix, m)
-			wg.Done()
+			defer wg.Done()
+			for i := range queue {
+				if aborted.Load() {
+					continue
+				}
+				run(i)
+			}
 		}()
 	}
 
-	if len(hosts) <= 1 && prefix == "" {
-		cmd.Stderr = os.Stderr
-	} else {
-		stderr, err := cmd.StderrPipe()
+	for _, i := range indexes {
+		if aborted.Load() {
+			break
+		}
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// splitBatches splits indexes of the hosts into batches that have the sizes at most.
+// The last size is used for the rest of the batches.
+func splitBatches(total int, sizes []int) [][]int {
+	batches := [][]int{}
+	for start := 0; start < total; {
+		size := sizes[len(sizes)-1]
+		if len(batches) < len(sizes) {
+			size = sizes[len(batches)]
+		}
+
+		end := start + size
+		if end > total {
+			end = total
+		}
+
+		batch := []int{}
+		for i := start; i < end; i++ {
+			batch = append(batch, i)
+		}
+		batches = append(batches, batch)
+		start = end
+	}
+
+	return batches
+}
+
+// pauseBatch waits before running the next batch by the task's batch_pause setting.
+func pauseBatch(ctx context.Context, task *Task) error {
+	if task.BatchPauseConfirm {
+		tty, err := os.Open("/dev/tty")
+		if err != nil {
+			return fmt.Errorf("couldn't ask to continue the next batch: %v", err)
+		}
+		defer tty.Close()
+
+		fmt.Fprint(os.Stderr, color.FgYB("essh: continue to the next batch? [y/N]: "))
+		answer, err := bufio.NewReader(tty).ReadString('\n')
 		if err != nil {
 			return err
 		}
-		wg.Add(1)
-		go func() {
-			scanLines(stderr, os.Stderr, prefix, m)
-			wg.Done()
-		}()
+
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			return fmt.Errorf("canceled running the next batch.")
+		}
+
+		return nil
+	}
+
+	if task.BatchPause > 0 {
+		fmt.Fprint(os.Stderr, color.FgYB("essh: waiting %v before the next batch.\n", task.BatchPause))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(task.BatchPause):
+		}
 	}
 
-	err = cmd.Start()
+	return nil
+}
+
+// taskCommand is a command that runs task's script on a host.
+type taskCommand struct {
+	// Content is the script generated by the driver.
+	Content string
+	// Script is the content wrapped to run by the privileged or the specific user.
+	Script string
+	Args   []string
+}
+
+func newRemoteTaskCommand(sshConfigPath string, task *Task, host *Host) (*taskCommand, error) {
+	// setup ssh command args
+	var sshCommandArgs []string
+	if task.Pty {
+		sshCommandArgs = []string{"-t", "-t", "-F", sshConfigPath, host.Name}
+	} else {
+		sshCommandArgs = []string{"-F", sshConfigPath, host.Name}
+	}
+
+	content, err := generateTaskContent(sshConfigPath, task, host)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	wg.Wait()
+	script := content
+	if task.User != "" {
+		script = "sudo -u " + ShellEscape(task.User) + " bash -l -c " + ShellEscape(script)
+	} else if task.Privileged {
+		script = "sudo bash -l -c " + ShellEscape(script)
+	}
 
-	return cmd.Wait()
+	sshCommandArgs = append(sshCommandArgs, "bash", "-c", ShellEscape(script))
+
+	if task.SSHOptions != nil {
+		sshCommandArgs = append(task.SSHOptions, sshCommandArgs[:]...)
+	}
+
+	return &taskCommand{
+		Content: content,
+		Script:  script,
+		Args:    append([]string{"ssh"}, sshCommandArgs...),
+	}, nil
 }
 
-func runLocalTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*Host, stdinCh chan []byte, m *sync.Mutex) error {
+func newLocalTaskCommand(sshConfigPath string, task *Task, host *Host) (*taskCommand, error) {
 	var shell, flag string
 	if runtime.GOOS == "windows" {
 		shell = "cmd"
@@ -302,27 +684,12 @@ func runLocalTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*H
 		flag = "-c"
 	}
 
-	// generate commands by using driver
-	if task.Driver == "" {
-		task.Driver = DefaultDriverName
-	}
-
-	driver := Drivers[task.Driver]
-	if driver == nil {
-		return fmt.Errorf("invalid driver name '%s'", task.Driver)
-	}
-
-	if debugFlag {
-		fmt.Printf("[essh debug] driver: %s \n", driver.Name)
-	}
-
-	var script string
-	content, err := driver.GenerateRunnableContent(sshConfigPath, task, host)
+	content, err := generateTaskContent(sshConfigPath, task, host)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	script += content
 
+	script := content
 	if task.User != "" {
 		script = "cd " + WorkingDir + "\n" + script
 		script = "sudo -u " + ShellEscape(task.User) + " bash -l -c " + ShellEscape(script)
@@ -331,11 +698,66 @@ func runLocalTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*H
 		script = "sudo bash -l -c " + ShellEscape(script)
 	}
 
-	cmd := exec.Command(shell, flag, script)
+	return &taskCommand{
+		Content: content,
+		Script:  script,
+		Args:    []string{shell, flag, script},
+	}, nil
+}
+
+// prepareTaskContents generates the task's scripts for the target hosts in advance,
+// because the driver's engine may call lua functions that can't run in the concurrent goroutines.
+// It must be called in the goroutine that can use the lua state.
+func prepareTaskContents(sshConfigPath string, task *Task) error {
+	task.Contents = map[*Host]string{}
+	if len(task.Steps) > 0 {
+		return nil
+	}
+
+	hosts := selectTaskHosts(task)
+	if len(hosts) == 0 {
+		if task.IsRemoteTask() {
+			return nil
+		}
+		// local task without hosts
+		hosts = []*Host{nil}
+	}
+
+	for _, host := range hosts {
+		content, err := generateTaskContent(sshConfigPath, task, host)
+		if err != nil {
+			return err
+		}
+		task.Contents[host] = content
+	}
+
+	return nil
+}
+
+// generateTaskContent generates the task's script for the host by using the driver.
+func generateTaskContent(sshConfigPath string, task *Task, host *Host) (string, error) {
+	if content, ok := task.Contents[host]; ok {
+		return content, nil
+	}
+
+	if task.Driver == "" {
+		task.Driver = DefaultDriverName
+	}
+
+	driver := Drivers[task.Driver]
+	if driver == nil {
+		return "", fmt.Errorf("invalid driver name '%s'", task.Driver)
+	}
+
 	if debugFlag {
-		fmt.Printf("[essh debug] real local command: %v \n", cmd.Args)
+		fmt.Printf("[essh debug] driver: %s \n", driver.Name)
 	}
 
+	return driver.GenerateRunnableContent(sshConfigPath, task, host)
+}
+
+// taskPrefix returns the prefix of the output lines of the host.
+func taskPrefix(task *Task, host *Host, hosts []*Host) (string, error) {
 	prefix := ""
 	if host == nil && task.UsePrefix {
 		// simple local task (does not specify the hosts)
@@ -366,17 +788,40 @@ func runLocalTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*H
 		}
 		tmpl, err := template.New("T").Funcs(funcMap).Parse(prefixTmp)
 		if err != nil {
-			return err
+			return "", err
 		}
 		var b bytes.Buffer
 		err = tmpl.Execute(&b, dict)
 		if err != nil {
-			return err
+			return "", err
 		}
 
 		prefix = b.String()
 	}
 
+	return prefix, nil
+}
+
+func runRemoteTaskScript(ctx context.Context, sshConfigPath string, task *Task, host *Host, hosts []*Host, stdinCh chan []byte, m *sync.Mutex, r *HostResult) error {
+	c, err := newRemoteTaskCommand(sshConfigPath, task, host)
+	if err != nil {
+		return err
+	}
+
+	r.Script = c.Script
+	cmd := exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+	if _, ok := ctx.Deadline(); ok {
+		cmd.WaitDelay = killWaitDelay
+	}
+	if debugFlag {
+		fmt.Printf("[essh debug] real ssh command: %v \n", cmd.Args)
+	}
+
+	prefix, err := taskPrefix(task, host, hosts)
+	if err != nil {
+		return err
+	}
+
 	// cmd.Stdin = os.Stdin
 
 	// see https://github.com/kohkimakimoto/essh/issues/38
@@ -390,57 +835,69 @@ func runLocalTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*H
 		go handleInput(stdinCh, stdin)
 	}
 
-	wg := &sync.WaitGroup{}
-	if len(hosts) <= 1 && prefix == "" {
-		cmd.Stdout = os.Stdout
-	} else {
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			return err
-		}
-		wg.Add(1)
-		go func() {
-			scanLines(stdout, os.Stdout, prefix, m)
-			wg.Done()
-		}()
+	var flush func()
+	cmd.Stdout, cmd.Stderr, flush = setupOutput(task, host, hosts, prefix, m, r)
+	defer flush()
+
+	return cmd.Run()
+}
+
+func runLocalTaskScript(ctx context.Context, sshConfigPath string, task *Task, host *Host, hosts []*Host, stdinCh chan []byte, m *sync.Mutex, r *HostResult) error {
+	c, err := newLocalTaskCommand(sshConfigPath, task, host)
+	if err != nil {
+		return err
 	}
 
-	if len(hosts) <= 1 && prefix == "" {
-		cmd.Stderr = os.Stderr
-	} else {
-		stderr, err := cmd.StderrPipe()
-		if err != nil {
-			return err
-		}
-		wg.Add(1)
-		go func() {
-			scanLines(stderr, os.Stderr, prefix, m)
-			wg.Done()
-		}()
+	r.Script = c.Script
+	cmd := exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+	if _, ok := ctx.Deadline(); ok {
+		cmd.WaitDelay = killWaitDelay
+	}
+	if debugFlag {
+		fmt.Printf("[essh debug] real local command: %v \n", cmd.Args)
 	}
 
-	err = cmd.Start()
+	prefix, err := taskPrefix(task, host, hosts)
 	if err != nil {
 		return err
 	}
 
-	wg.Wait()
+	// cmd.Stdin = os.Stdin
 
-	return cmd.Wait()
+	// see https://github.com/kohkimakimoto/essh/issues/38
+	if stdinCh == nil {
+		cmd.Stdin = os.Stdin
+	} else {
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		go handleInput(stdinCh, stdin)
+	}
+
+	var flush func()
+	cmd.Stdout, cmd.Stderr, flush = setupOutput(task, host, hosts, prefix, m, r)
+	defer flush()
+
+	return cmd.Run()
 }
 
 func runSSH(L *lua.LState, config string, args []string) (error, int) {
 	// hooks
 	hooks := map[string][]interface{}{}
+	hooksTimeout := timeoutVar
 
 	// Limitation!
 	// hooks fires only when the hostname is just specified.
 	if len(args) == 1 {
 		hostname := args[0]
-		if host := Hosts[hostname]; host != nil {
+		if host := FindHost(hostname); host != nil {
 			hooks["before_connect"] = host.HooksBeforeConnect
 			hooks["after_disconnect"] = host.HooksAfterDisconnect
 			hooks["after_connect"] = host.HooksAfterConnect
+			if hooksTimeout == 0 {
+				hooksTimeout = host.HooksTimeout
+			}
 		}
 	}
 
@@ -456,12 +913,13 @@ func runSSH(L *lua.LState, config string, args []string) (error, int) {
 		if debugFlag {
 			fmt.Printf("[essh debug] before_connect hook script: %s\n", hookScript)
 		}
-		if err := runCommand(hookScript); err != nil {
+		if err := runCommand(hooksTimeout, hookScript); err != nil {
 			return err, ExitErr
 		}
 	}
 
 	// register after_disconnect hook
+	// its error is printed instead of returned to keep the exit code of ssh.
 	defer func() {
 		// after hook
 		if after := hooks["after_disconnect"]; after != nil && len(after) > 0 {
@@ -470,13 +928,14 @@ func runSSH(L *lua.LState, config string, args []string) (error, int) {
 			}
 			hookScript, err := getHookScript(L, after)
 			if err != nil {
-				panic(err)
+				printError(fmt.Errorf("after_disconnect hook failed: %v", err))
+				return
 			}
 			if debugFlag {
 				fmt.Printf("[essh debug] after_disconnect hook script: %s\n", hookScript)
 			}
-			if err := runCommand(hookScript); err != nil {
-				panic(err)
+			if err := runCommand(hooksTimeout, hookScript); err != nil {
+				printError(fmt.Errorf("after_disconnect hook failed: %v", err))
 			}
 		}
 	}()
@@ -0,0 +1,133 @@
+package essh
+
+import (
+	"context"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// exitError returns the error of a command that exited with the code.
+func exitError(t *testing.T, code int) error {
+	err := exec.Command("sh", "-c", "exit "+strconv.Itoa(code)).Run()
+	if err == nil {
+		t.Fatalf("the command must fail with %d", code)
+	}
+
+	return err
+}
+
+func TestRunWithRetry(t *testing.T) {
+	cases := []struct {
+		desc        string
+		attempts    int
+		onExitCodes []int
+		codes       []int
+		runs        int
+		code        int
+	}{
+		{desc: "success", attempts: 3, codes: []int{0}, runs: 1, code: 0},
+		{desc: "255 is retried by default", attempts: 3, codes: []int{255, 0}, runs: 2, code: 0},
+		{desc: "the other codes are not retried by default", attempts: 3, codes: []int{1, 0}, runs: 1, code: 1},
+		{desc: "on_exit_codes are retried", attempts: 3, onExitCodes: []int{1}, codes: []int{1, 1, 0}, runs: 3, code: 0},
+		{desc: "255 is retried with on_exit_codes", attempts: 3, onExitCodes: []int{1}, codes: []int{255, 1, 0}, runs: 3, code: 0},
+		{desc: "codes not in on_exit_codes are not retried", attempts: 3, onExitCodes: []int{1}, codes: []int{2, 0}, runs: 1, code: 2},
+		{desc: "attempts are respected", attempts: 2, codes: []int{255, 255, 0}, runs: 2, code: 255},
+		{desc: "one attempt doesn't retry", attempts: 1, codes: []int{255, 0}, runs: 1, code: 255},
+	}
+
+	for _, c := range cases {
+		task := NewTask()
+		task.Name = "retry"
+		task.Retry = NewRetryPolicy()
+		task.Retry.Attempts = c.attempts
+		task.Retry.OnExitCodes = append(task.Retry.OnExitCodes, c.onExitCodes...)
+
+		runs := 0
+		err := runWithRetry(context.Background(), task, nil, func(ctx context.Context) error {
+			code := c.codes[runs]
+			runs++
+			if code == 0 {
+				return nil
+			}
+			return exitError(t, code)
+		})
+
+		if runs != c.runs {
+			t.Errorf("%s: expected %d runs, but got %d", c.desc, c.runs, runs)
+		}
+		code := 0
+		if err != nil {
+			code = resolveExitCode(err)
+		}
+		if code != c.code {
+			t.Errorf("%s: expected the exit code %d, but got %d (%v)", c.desc, c.code, code, err)
+		}
+	}
+}
+
+func TestRunWithRetryStopsOnCancel(t *testing.T) {
+	task := NewTask()
+	task.Name = "retry"
+	task.Retry = NewRetryPolicy()
+	task.Retry.Attempts = 3
+	task.Retry.Delay = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	runs := 0
+	err := runWithRetry(ctx, task, nil, func(ctx context.Context) error {
+		runs++
+		return exitError(t, 255)
+	})
+	if runs != 1 || err == nil {
+		t.Errorf("expected 1 failed run, but got %d runs (%v)", runs, err)
+	}
+}
+
+func TestRetryPolicyNextDelay(t *testing.T) {
+	cases := []struct {
+		backoff  float64
+		maxDelay time.Duration
+		delays   []time.Duration
+	}{
+		{backoff: 1, maxDelay: DefaultRetryMaxDelay, delays: []time.Duration{time.Second, time.Second, time.Second}},
+		{backoff: 2, maxDelay: DefaultRetryMaxDelay, delays: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}},
+		{backoff: 2, maxDelay: 5 * time.Second, delays: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}},
+		{backoff: 10, maxDelay: DefaultRetryMaxDelay, delays: []time.Duration{time.Minute, DefaultRetryMaxDelay, DefaultRetryMaxDelay}},
+	}
+
+	for _, c := range cases {
+		r := NewRetryPolicy()
+		r.Backoff = c.backoff
+		r.MaxDelay = c.maxDelay
+		for i := 1; i < len(c.delays); i++ {
+			if d := r.NextDelay(c.delays[i-1]); d != c.delays[i] {
+				t.Errorf("backoff %v, max delay %v: expected %v after %v, but got %v", c.backoff, c.maxDelay, c.delays[i], c.delays[i-1], d)
+			}
+		}
+	}
+}
+
+func TestRunWithRetryCapsDelay(t *testing.T) {
+	task := NewTask()
+	task.Name = "retry"
+	task.Retry = NewRetryPolicy()
+	task.Retry.Attempts = 4
+	task.Retry.Delay = 20 * time.Millisecond
+	task.Retry.Backoff = 100
+	task.Retry.MaxDelay = 30 * time.Millisecond
+
+	start := time.Now()
+	err := runWithRetry(context.Background(), task, nil, func(ctx context.Context) error {
+		return exitError(t, 255)
+	})
+	elapsed := time.Since(start)
+
+	// 20ms, 30ms and 30ms instead of 20ms, 2s and 200s.
+	if err == nil || elapsed < 80*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected the capped delays, but it took %v (%v)", elapsed, err)
+	}
+}
@@ -0,0 +1,320 @@
+package essh
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Selector decides whether a host is selected by an expression used in --select, --target, --filter and so on.
+//
+// The expression supports:
+//
+//	web                   a host name or a tag
+//	db-*                  a glob pattern for host names and tags
+//	/^edge[0-9]+$/        a regular expression for host names and tags
+//	props.region=eu-west  a value of the host's props (glob patterns can be used in the value)
+//	web && !staging       operators '&&', '||', '!' and parentheses
+type Selector interface {
+	Match(host *Host) bool
+}
+
+// ParseSelector parses the selector expression.
+func ParseSelector(expr string) (Selector, error) {
+	tokens, err := tokenizeSelector(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("invalid selector '%s': empty expression", expr)
+	}
+
+	p := &selectorParser{expr: expr, tokens: tokens}
+	sel, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("invalid selector '%s': unexpected '%s'", expr, p.tokens[p.pos])
+	}
+
+	return sel, nil
+}
+
+// ValidateSelectors returns an error if one of the expressions is invalid.
+func ValidateSelectors(exprs []string) error {
+	for _, expr := range exprs {
+		if _, err := ParseSelector(expr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compileSelectors parses the expressions once to match many hosts.
+// An invalid expression is treated as a host name or a tag for backward compatibility.
+func compileSelectors(exprs []string) []Selector {
+	sels := make([]Selector, 0, len(exprs))
+	for _, expr := range exprs {
+		sel, err := ParseSelector(expr)
+		if err != nil {
+			sel = &nameOrTagSelector{name: expr}
+		}
+		sels = append(sels, sel)
+	}
+
+	return sels
+}
+
+func tokenizeSelector(expr string) ([]string, error) {
+	tokens := []string{}
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == ')' || c == '!':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '&' || c == '|':
+			if i+1 >= len(runes) || runes[i+1] != c {
+				return nil, fmt.Errorf("invalid selector '%s': use '%c%c'", expr, c, c)
+			}
+			tokens = append(tokens, string([]rune{c, c}))
+			i += 2
+		case c == '/':
+			j := i + 1
+			for ; j < len(runes) && runes[j] != '/'; j++ {
+				if runes[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("invalid selector '%s': unterminated regular expression", expr)
+			}
+			tokens = append(tokens, string(runes[i:j+1]))
+			i = j + 1
+		default:
+			j := i
+			for ; j < len(runes) && !unicode.IsSpace(runes[j]) && !strings.ContainsRune("()!&|", runes[j]); j++ {
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		}
+	}
+
+	return tokens, nil
+}
+
+type selectorParser struct {
+	expr   string
+	tokens []string
+	pos    int
+}
+
+func (p *selectorParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+
+	return ""
+}
+
+func (p *selectorParser) parseOr() (Selector, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "||" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orSelector{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *selectorParser) parseAnd() (Selector, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "&&" {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andSelector{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *selectorParser) parseNot() (Selector, error) {
+	if p.peek() == "!" {
+		p.pos++
+		sel, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notSelector{sel: sel}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *selectorParser) parsePrimary() (Selector, error) {
+	token := p.peek()
+	switch token {
+	case "":
+		return nil, fmt.Errorf("invalid selector '%s': unexpected end of the expression", p.expr)
+	case "&&", "||", ")":
+		return nil, fmt.Errorf("invalid selector '%s': unexpected '%s'", p.expr, token)
+	case "(":
+		p.pos++
+		sel, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("invalid selector '%s': missing ')'", p.expr)
+		}
+		p.pos++
+		return sel, nil
+	}
+
+	p.pos++
+
+	if strings.HasPrefix(token, "/") {
+		re, err := regexp.Compile(token[1 : len(token)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector '%s': %v", p.expr, err)
+		}
+		return &regexpSelector{re: re}, nil
+	}
+
+	if strings.HasPrefix(token, "props.") {
+		key, value, hasValue := strings.Cut(strings.TrimPrefix(token, "props."), "=")
+		if key == "" {
+			return nil, fmt.Errorf("invalid selector '%s': props requires a key", p.expr)
+		}
+		if _, err := path.Match(value, ""); err != nil {
+			return nil, fmt.Errorf("invalid selector '%s': %v", p.expr, err)
+		}
+		return &propsSelector{key: key, value: value, hasValue: hasValue}, nil
+	}
+
+	if strings.ContainsAny(token, "*?[") {
+		if _, err := path.Match(token, ""); err != nil {
+			return nil, fmt.Errorf("invalid selector '%s': %v", p.expr, err)
+		}
+		return &globSelector{pattern: token}, nil
+	}
+
+	return &nameOrTagSelector{name: token}, nil
+}
+
+type orSelector struct {
+	left, right Selector
+}
+
+func (s *orSelector) Match(host *Host) bool {
+	return s.left.Match(host) || s.right.Match(host)
+}
+
+type andSelector struct {
+	left, right Selector
+}
+
+func (s *andSelector) Match(host *Host) bool {
+	return s.left.Match(host) && s.right.Match(host)
+}
+
+type notSelector struct {
+	sel Selector
+}
+
+func (s *notSelector) Match(host *Host) bool {
+	return !s.sel.Match(host)
+}
+
+type nameOrTagSelector struct {
+	name string
+}
+
+func (s *nameOrTagSelector) Match(host *Host) bool {
+	if host.Name == s.name {
+		return true
+	}
+
+	for _, tag := range host.Tags {
+		if tag == s.name {
+			return true
+		}
+	}
+
+	return false
+}
+
+type globSelector struct {
+	pattern string
+}
+
+func (s *globSelector) Match(host *Host) bool {
+	if ok, _ := path.Match(s.pattern, host.Name); ok {
+		return true
+	}
+
+	for _, tag := range host.Tags {
+		if ok, _ := path.Match(s.pattern, tag); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+type regexpSelector struct {
+	re *regexp.Regexp
+}
+
+func (s *regexpSelector) Match(host *Host) bool {
+	if s.re.MatchString(host.Name) {
+		return true
+	}
+
+	for _, tag := range host.Tags {
+		if s.re.MatchString(tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// propsSelector matches the host's props. Without the value, it matches the host that has the non-empty prop.
+type propsSelector struct {
+	key      string
+	value    string
+	hasValue bool
+}
+
+func (s *propsSelector) Match(host *Host) bool {
+	v, ok := host.Props[s.key]
+	if !s.hasValue {
+		return ok && v != ""
+	}
+
+	matched, _ := path.Match(s.value, v)
+	return ok && matched
+}
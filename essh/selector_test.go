@@ -0,0 +1,110 @@
+package essh
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestSelectorHosts() []*Host {
+	return []*Host{
+		newTestHost("web1", []string{"web", "production"}, map[string]string{"region": "eu-west"}),
+		newTestHost("web2", []string{"web", "staging"}, map[string]string{"region": "us-east"}),
+		newTestHost("db1", []string{"db", "production"}, map[string]string{"region": "eu-west", "role": ""}),
+		newTestHost("edge10", []string{"edge"}, map[string]string{"role": "cache"}),
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	cases := []struct {
+		expr     string
+		expected []string
+	}{
+		{expr: "web", expected: []string{"web1", "web2"}},
+		{expr: "db1", expected: []string{"db1"}},
+		{expr: "web*", expected: []string{"web1", "web2"}},
+		{expr: "/^edge[0-9]+$/", expected: []string{"edge10"}},
+		{expr: "/^(web|db)1$/", expected: []string{"web1", "db1"}},
+		{expr: "props.region=eu-west", expected: []string{"web1", "db1"}},
+		{expr: "props.region=*-east", expected: []string{"web2"}},
+		{expr: "props.role", expected: []string{"edge10"}},
+		{expr: "!web", expected: []string{"db1", "edge10"}},
+		{expr: "!!web", expected: []string{"web1", "web2"}},
+		{expr: "web && !staging", expected: []string{"web1"}},
+		{expr: "web && production || edge", expected: []string{"web1", "edge10"}},
+		{expr: "edge || web && production", expected: []string{"web1", "edge10"}},
+		{expr: "edge || web && staging", expected: []string{"web2", "edge10"}},
+		{expr: "(edge || web) && staging", expected: []string{"web2"}},
+		{expr: "!(web || db)", expected: []string{"edge10"}},
+		{expr: "production && (props.region=eu-west || staging)", expected: []string{"web1", "db1"}},
+		{expr: "unknown", expected: []string{}},
+	}
+
+	hosts := newTestSelectorHosts()
+	for _, c := range cases {
+		sel, err := ParseSelector(c.expr)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.expr, err)
+			continue
+		}
+		matched := []string{}
+		for _, host := range hosts {
+			if sel.Match(host) {
+				matched = append(matched, host.Name)
+			}
+		}
+		if !reflect.DeepEqual(matched, c.expected) {
+			t.Errorf("%q: expected %v, but got %v", c.expr, c.expected, matched)
+		}
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	cases := []struct {
+		expr string
+		err  string
+	}{
+		{expr: "", err: "empty expression"},
+		{expr: "   ", err: "empty expression"},
+		{expr: "web & db", err: "use '&&'"},
+		{expr: "web | db", err: "use '||'"},
+		{expr: "web &&", err: "unexpected end of the expression"},
+		{expr: "|| web", err: "unexpected '||'"},
+		{expr: "!", err: "unexpected end of the expression"},
+		{expr: "(web || db", err: "missing ')'"},
+		{expr: "web)", err: "unexpected ')'"},
+		{expr: "()", err: "unexpected ')'"},
+		{expr: "/web", err: "unterminated regular expression"},
+		{expr: "/web[/", err: "missing closing ]"},
+		{expr: "props.=x", err: "props requires a key"},
+		{expr: "props.region=[", err: "syntax error in pattern"},
+		{expr: "web[", err: "syntax error in pattern"},
+	}
+
+	for _, c := range cases {
+		_, err := ParseSelector(c.expr)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: expected the error '%s', but got %v", c.expr, c.err, err)
+		}
+	}
+}
+
+func TestCompileSelectors(t *testing.T) {
+	hosts := newTestSelectorHosts()
+	sels := compileSelectors([]string{"web && staging", "db1"})
+	if len(sels) != 2 {
+		t.Fatalf("expected 2 selectors, but got %d", len(sels))
+	}
+	if !sels[0].Match(hosts[1]) || sels[0].Match(hosts[0]) {
+		t.Errorf("'web && staging' must match only web2")
+	}
+	if !sels[1].Match(hosts[2]) {
+		t.Errorf("'db1' must match db1")
+	}
+
+	// an invalid expression is treated as a host name or a tag.
+	host := newTestHost("web|db", nil, nil)
+	if sel := compileSelectors([]string{"web|db"})[0]; !sel.Match(host) || sel.Match(hosts[0]) {
+		t.Errorf("the invalid expression must match only the host of the same name")
+	}
+}
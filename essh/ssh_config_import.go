@@ -0,0 +1,345 @@
+package essh
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/sevir/essh/support/color"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// SSHConfigHost is a host imported from OpenSSH config files.
+type SSHConfigHost struct {
+	Name   string
+	Params []*SSHConfigParam
+}
+
+type SSHConfigParam struct {
+	Key    string
+	Values []string
+}
+
+// maxSSHConfigIncludeDepth is the max depth of nested Include directives like OpenSSH.
+const maxSSHConfigIncludeDepth = 16
+
+// sshConfigKeywords are the keywords of ssh_config(5) to normalize their case, because essh treats a lower case key as essh's property.
+var sshConfigKeywords = map[string]string{}
+
+func init() {
+	for _, keyword := range []string{
+		"AddKeysToAgent", "AddressFamily", "BatchMode", "BindAddress", "BindInterface", "CanonicalDomains",
+		"CanonicalizeFallbackLocal", "CanonicalizeHostname", "CanonicalizeMaxDots", "CanonicalizePermittedCNAMEs",
+		"CASignatureAlgorithms", "CertificateFile", "ChallengeResponseAuthentication", "CheckHostIP", "Ciphers",
+		"ClearAllForwardings", "Compression", "ConnectionAttempts", "ConnectTimeout", "ControlMaster", "ControlPath",
+		"ControlPersist", "DynamicForward", "EnableEscapeCommandline", "EnableSSHKeysign", "EscapeChar",
+		"ExitOnForwardFailure", "FingerprintHash", "ForkAfterAuthentication", "ForwardAgent", "ForwardX11",
+		"ForwardX11Timeout", "ForwardX11Trusted", "GatewayPorts", "GlobalKnownHostsFile", "GSSAPIAuthentication",
+		"GSSAPIDelegateCredentials", "HashKnownHosts", "HostbasedAcceptedAlgorithms", "HostbasedAuthentication",
+		"HostKeyAlgorithms", "HostKeyAlias", "HostName", "IdentitiesOnly", "IdentityAgent", "IdentityFile", "IPQoS",
+		"KbdInteractiveAuthentication", "KbdInteractiveDevices", "KexAlgorithms", "KnownHostsCommand", "LocalCommand",
+		"LocalForward", "LogLevel", "LogVerbose", "MACs", "NoHostAuthenticationForLocalhost", "NumberOfPasswordPrompts",
+		"PasswordAuthentication", "PermitLocalCommand", "PermitRemoteOpen", "PKCS11Provider", "Port",
+		"PreferredAuthentications", "ProxyCommand", "ProxyJump", "ProxyUseFdpass", "PubkeyAcceptedAlgorithms",
+		"PubkeyAcceptedKeyTypes", "PubkeyAuthentication", "RekeyLimit", "RemoteCommand", "RemoteForward", "RequestTTY",
+		"RequiredRSASize", "RevokedHostKeys", "SecurityKeyProvider", "SendEnv", "ServerAliveCountMax",
+		"ServerAliveInterval", "SessionType", "SetEnv", "StdinNull", "StreamLocalBindMask", "StreamLocalBindUnlink",
+		"StrictHostKeyChecking", "SyslogFacility", "TCPKeepAlive", "Tag", "Tunnel", "TunnelDevice", "UpdateHostKeys",
+		"UseKeychain", "User", "UserKnownHostsFile", "VerifyHostKeyDNS", "VisualHostKey", "XAuthLocation",
+	} {
+		sshConfigKeywords[strings.ToLower(keyword)] = keyword
+	}
+}
+
+// multiValuedSSHConfigKeywords are the keywords that OpenSSH accumulates instead of using the first obtained value.
+var multiValuedSSHConfigKeywords = map[string]bool{
+	"CertificateFile": true,
+	"DynamicForward":  true,
+	"IdentityFile":    true,
+	"LocalForward":    true,
+	"RemoteForward":   true,
+	"SendEnv":         true,
+}
+
+// normalizeSSHConfigKeyword returns the keyword in the case of ssh_config(5). An unknown keyword is capitalized.
+func normalizeSSHConfigKeyword(keyword string) string {
+	if k, ok := sshConfigKeywords[strings.ToLower(keyword)]; ok {
+		return k
+	}
+
+	return strings.ToUpper(keyword[:1]) + keyword[1:]
+}
+
+type sshConfigLine struct {
+	file  string
+	line  int
+	key   string
+	value string
+}
+
+// ParseSSHConfig parses the OpenSSH config file and returns the hosts that have concrete names.
+// The params of the Host blocks that have patterns like `Host *` are applied to the matched hosts as defaults,
+// and the first obtained value is used for each param like OpenSSH. The values of the keywords like IdentityFile are accumulated.
+// The patterns themselves aren't returned, so the hosts that are matched only by patterns aren't imported.
+// Match blocks are skipped with a warning.
+func ParseSSHConfig(path string) ([]*SSHConfigHost, error) {
+	path = expandHomeDir(path)
+	lines, err := readSSHConfigLines(path, filepath.Dir(path), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	type block struct {
+		patterns []string
+		lines    []*sshConfigLine
+	}
+
+	// the lines before the first Host block apply to all hosts.
+	blocks := []*block{{patterns: []string{"*"}}}
+	names := []string{}
+	seen := map[string]bool{}
+	for _, l := range lines {
+		switch strings.ToLower(l.key) {
+		case "host":
+			patterns := splitSSHConfigArgs(l.value)
+			blocks = append(blocks, &block{patterns: patterns})
+			for _, p := range patterns {
+				if !isSSHConfigPattern(p) && !seen[p] {
+					seen[p] = true
+					names = append(names, p)
+				}
+			}
+		case "match":
+			fmt.Fprint(os.Stderr, color.FgYB("essh: the Match block at %s:%d is not supported. it is skipped.\n", l.file, l.line))
+			blocks = append(blocks, &block{})
+		default:
+			current := blocks[len(blocks)-1]
+			current.lines = append(current.lines, l)
+		}
+	}
+
+	hosts := []*SSHConfigHost{}
+	for _, name := range names {
+		host := &SSHConfigHost{Name: name}
+		obtained := map[string]*SSHConfigParam{}
+		for _, b := range blocks {
+			if !matchSSHConfigPatterns(b.patterns, name) {
+				continue
+			}
+			for _, l := range b.lines {
+				key := normalizeSSHConfigKeyword(l.key)
+				if p, ok := obtained[key]; ok {
+					if multiValuedSSHConfigKeywords[key] {
+						p.Values = append(p.Values, l.value)
+					}
+					continue
+				}
+				p := &SSHConfigParam{Key: key, Values: []string{l.value}}
+				obtained[key] = p
+				host.Params = append(host.Params, p)
+			}
+		}
+		hosts = append(hosts, host)
+	}
+
+	return hosts, nil
+}
+
+// readSSHConfigLines reads the keyword lines of the file expanding Include directives.
+// Relative paths of Include are resolved from baseDir that is the directory of the top level file.
+func readSSHConfigLines(path string, baseDir string, depth int) ([]*sshConfigLine, error) {
+	if depth > maxSSHConfigIncludeDepth {
+		return nil, fmt.Errorf("too many nested Include directives: %s", path)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []*sshConfigLine{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		key, value := splitSSHConfigLine(text)
+		if value == "" {
+			return nil, fmt.Errorf("%s:%d: '%s' requires a value.", path, n, key)
+		}
+
+		if strings.EqualFold(key, "include") {
+			for _, pattern := range splitSSHConfigArgs(value) {
+				pattern = expandHomeDir(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(baseDir, pattern)
+				}
+				files, err := filepath.Glob(pattern)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+				}
+				for _, file := range files {
+					included, err := readSSHConfigLines(file, baseDir, depth+1)
+					if err != nil {
+						return nil, err
+					}
+					lines = append(lines, included...)
+				}
+			}
+			continue
+		}
+
+		lines = append(lines, &sshConfigLine{file: path, line: n, key: key, value: value})
+	}
+
+	return lines, scanner.Err()
+}
+
+// splitSSHConfigLine splits a line like `Key value` or `Key=value`.
+func splitSSHConfigLine(text string) (string, string) {
+	i := strings.IndexAny(text, " \t=")
+	if i < 0 {
+		return text, ""
+	}
+
+	key := text[:i]
+	value := strings.TrimSpace(text[i:])
+	value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) && !strings.Contains(value[1:len(value)-1], `"`) {
+		value = value[1 : len(value)-1]
+	}
+
+	return key, value
+}
+
+// splitSSHConfigArgs splits the arguments separated by spaces. Double quoted arguments can contain spaces.
+func splitSSHConfigArgs(value string) []string {
+	args := []string{}
+	var arg strings.Builder
+	quoted := false
+	for _, c := range value {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case (c == ' ' || c == '\t') && !quoted:
+			if arg.Len() > 0 {
+				args = append(args, arg.String())
+				arg.Reset()
+			}
+		default:
+			arg.WriteRune(c)
+		}
+	}
+	if arg.Len() > 0 {
+		args = append(args, arg.String())
+	}
+
+	return args
+}
+
+func isSSHConfigPattern(name string) bool {
+	return strings.ContainsAny(name, "*?!")
+}
+
+// matchSSHConfigPatterns returns true if the name matches one of the patterns and doesn't match the negated patterns like `!bastion`.
+func matchSSHConfigPatterns(patterns []string, name string) bool {
+	matched := false
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "!") {
+			if matchSSHConfigPattern(p[1:], name) {
+				return false
+			}
+		} else if matchSSHConfigPattern(p, name) {
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+// matchSSHConfigPattern matches the name with the pattern that has wildcards `*` and `?`.
+func matchSSHConfigPattern(pattern string, name string) bool {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+
+	matched, _ := regexp.MatchString("^"+expr+"$", name)
+	return matched
+}
+
+// GenHostsLua generates the lua code that defines the hosts.
+func GenHostsLua(hosts []*SSHConfigHost, source string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "-- imported from %s\n", source)
+	for _, host := range hosts {
+		fmt.Fprintf(&b, "\nhost %s {\n", luaQuote(host.Name))
+		for _, p := range host.Params {
+			key := p.Key
+			if !luaIdentifierRegexp.MatchString(key) {
+				key = "[" + luaQuote(key) + "]"
+			}
+			if len(p.Values) == 1 {
+				fmt.Fprintf(&b, "    %s = %s,\n", key, luaQuote(p.Values[0]))
+				continue
+			}
+			values := []string{}
+			for _, v := range p.Values {
+				values = append(values, luaQuote(v))
+			}
+			fmt.Fprintf(&b, "    %s = {%s},\n", key, strings.Join(values, ", "))
+		}
+		fmt.Fprint(&b, "}\n")
+	}
+
+	return b.Bytes()
+}
+
+var luaIdentifierRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func luaQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+
+	return `"` + s + `"`
+}
+
+func defaultSSHConfigFile() string {
+	return filepath.Join(userHomeDir(), ".ssh", "config")
+}
+
+// esshLoadSSHConfig registers the hosts of the OpenSSH config file, and returns a table of them keyed by the names.
+func esshLoadSSHConfig(L *lua.LState) int {
+	path := L.OptString(1, defaultSSHConfigFile())
+
+	hosts, err := ParseSSHConfig(path)
+	if err != nil {
+		L.RaiseError("failed to load the ssh config: %v", err)
+	}
+
+	hostsTb := L.NewTable()
+	for _, sshHost := range hosts {
+		h := registerHost(L, sshHost.Name)
+		for _, p := range sshHost.Params {
+			if len(p.Values) == 1 {
+				updateHost(L, h, p.Key, lua.LString(p.Values[0]))
+				continue
+			}
+			values := L.NewTable()
+			for _, v := range p.Values {
+				values.Append(lua.LString(v))
+			}
+			updateHost(L, h, p.Key, values)
+		}
+		hostsTb.RawSetString(sshHost.Name, newLHost(L, h))
+	}
+
+	L.Push(hostsTb)
+	return 1
+}
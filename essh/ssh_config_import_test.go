@@ -0,0 +1,188 @@
+package essh
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSSHConfig(t *testing.T) {
+	cases := []struct {
+		desc     string
+		files    map[string]string
+		expected []*SSHConfigHost
+	}{
+		{
+			desc: "hosts",
+			files: map[string]string{"config": `
+# comment
+Host web01 web02
+    HostName 192.168.0.1
+    port=2222
+Host db01
+    User "deploy"
+`},
+			expected: []*SSHConfigHost{
+				{Name: "web01", Params: []*SSHConfigParam{{Key: "HostName", Values: []string{"192.168.0.1"}}, {Key: "Port", Values: []string{"2222"}}}},
+				{Name: "web02", Params: []*SSHConfigParam{{Key: "HostName", Values: []string{"192.168.0.1"}}, {Key: "Port", Values: []string{"2222"}}}},
+				{Name: "db01", Params: []*SSHConfigParam{{Key: "User", Values: []string{"deploy"}}}},
+			},
+		},
+		{
+			desc: "include",
+			files: map[string]string{
+				"config": `
+Include conf.d/*.conf
+Host web01
+    User deploy
+`,
+				"conf.d/a.conf": `
+Host bastion
+    HostName 10.0.0.1
+`,
+				"conf.d/b.conf": `
+Include nested/c
+Host web01
+    Port 2222
+`,
+				"nested/c": `
+Host db01
+    Port 3333
+`,
+			},
+			expected: []*SSHConfigHost{
+				{Name: "bastion", Params: []*SSHConfigParam{{Key: "HostName", Values: []string{"10.0.0.1"}}}},
+				{Name: "db01", Params: []*SSHConfigParam{{Key: "Port", Values: []string{"3333"}}}},
+				{Name: "web01", Params: []*SSHConfigParam{{Key: "Port", Values: []string{"2222"}}, {Key: "User", Values: []string{"deploy"}}}},
+			},
+		},
+		{
+			desc: "defaults of patterns",
+			files: map[string]string{"config": `
+User root
+Host web01
+    User deploy
+Host bastion
+    HostName 10.0.0.1
+Host *.internal web*
+    Port 2222
+Host * !bastion
+    ProxyJump bastion
+    User admin
+`},
+			expected: []*SSHConfigHost{
+				{Name: "web01", Params: []*SSHConfigParam{{Key: "User", Values: []string{"root"}}, {Key: "Port", Values: []string{"2222"}}, {Key: "ProxyJump", Values: []string{"bastion"}}}},
+				{Name: "bastion", Params: []*SSHConfigParam{{Key: "User", Values: []string{"root"}}, {Key: "HostName", Values: []string{"10.0.0.1"}}}},
+			},
+		},
+		{
+			desc: "multiple values",
+			files: map[string]string{"config": `
+Host web01
+    IdentityFile ~/.ssh/web
+    LocalForward 8080 localhost:80
+    HostName 192.168.0.1
+    HostName 192.168.0.2
+Host *
+    IdentityFile ~/.ssh/default
+    LocalForward 8443 localhost:443
+    SendEnv LANG
+`},
+			expected: []*SSHConfigHost{
+				{Name: "web01", Params: []*SSHConfigParam{
+					{Key: "IdentityFile", Values: []string{"~/.ssh/web", "~/.ssh/default"}},
+					{Key: "LocalForward", Values: []string{"8080 localhost:80", "8443 localhost:443"}},
+					{Key: "HostName", Values: []string{"192.168.0.1"}},
+					{Key: "SendEnv", Values: []string{"LANG"}},
+				}},
+			},
+		},
+		{
+			desc: "match",
+			files: map[string]string{"config": `
+Host web01
+    Port 2222
+Match host web01
+    User root
+    Port 22
+Host db01
+    User deploy
+`},
+			expected: []*SSHConfigHost{
+				{Name: "web01", Params: []*SSHConfigParam{{Key: "Port", Values: []string{"2222"}}}},
+				{Name: "db01", Params: []*SSHConfigParam{{Key: "User", Values: []string{"deploy"}}}},
+			},
+		},
+		{
+			desc: "hosts matched only by patterns",
+			files: map[string]string{"config": `
+Host *.example.com
+    User deploy
+Host web0?
+    Port 2222
+`},
+			expected: []*SSHConfigHost{},
+		},
+	}
+
+	for _, c := range cases {
+		dir := t.TempDir()
+		for name, content := range c.files {
+			path := filepath.Join(dir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		hosts, err := ParseSSHConfig(filepath.Join(dir, "config"))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(hosts, c.expected) {
+			t.Errorf("%s: expected %s, but got %s", c.desc, formatSSHConfigHosts(c.expected), formatSSHConfigHosts(hosts))
+		}
+	}
+}
+
+func TestParseSSHConfigErrors(t *testing.T) {
+	cases := []struct {
+		desc    string
+		content string
+		err     string
+	}{
+		{desc: "no value", content: "Host web01\n    HostName\n", err: "'HostName' requires a value."},
+		{desc: "recursive include", content: "Include config\n", err: "too many nested Include directives"},
+	}
+
+	for _, c := range cases {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "config")
+		if err := os.WriteFile(path, []byte(c.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := ParseSSHConfig(path)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected the error '%s', but got %v", c.desc, c.err, err)
+		}
+	}
+}
+
+func formatSSHConfigHosts(hosts []*SSHConfigHost) string {
+	s := []string{}
+	for _, host := range hosts {
+		params := []string{}
+		for _, p := range host.Params {
+			params = append(params, p.Key+"="+strings.Join(p.Values, ","))
+		}
+		s = append(s, host.Name+"{"+strings.Join(params, " ")+"}")
+	}
+
+	return "[" + strings.Join(s, " ") + "]"
+}
@@ -3,6 +3,10 @@ package essh
 import (
 	"fmt"
 	"github.com/yuin/gopher-lua"
+	"math"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Task struct {
@@ -10,6 +14,16 @@ type Task struct {
 	Description string
 	Props       map[string]string
 	Prepare     func() error
+	// Env are the environment variables for the script. A value is a string or a lua function.
+	// Environ are the resolved values for each target host.
+	Env     map[string]interface{}
+	Environ map[string]map[string]string
+	// Contents are the scripts generated by the driver for the target hosts before running them.
+	Contents map[*Host]string
+	// OnSuccess, OnFailure and Finally are called with the results after running the script.
+	OnSuccess   func(results []*HostResult, err error) error
+	OnFailure   func(results []*HostResult, err error) error
+	Finally     func(results []*HostResult, err error) error
 	Driver      string
 	Pty         bool
 	Script      []map[string]string
@@ -17,21 +31,103 @@ type Task struct {
 	Backend     string
 	Targets     []string
 	Filters     []string
+	Depends     []string
 	Parallel    bool
-	Privileged  bool
-	User        string
-	SSHOptions  []string
+	MaxParallel int
+	OnError     string
+	Timeout     time.Duration
+	HostTimeout time.Duration
+	Retry       *RetryPolicy
+	// Serial is a number or a percentage like "20%" of hosts that run in a batch.
+	Serial            string
+	BatchPause        time.Duration
+	BatchPauseConfirm bool
+	MaxFailPercentage *float64
+	Privileged        bool
+	User              string
+	SSHOptions        []string
+	// When decides whether each target host runs the task's script. SkippedHosts are the hosts it excluded.
+	When         func(host *Host) (bool, error)
+	SkippedHosts []*Host
+	// TargetsQuery is a host query assigned to targets. It is evaluated again to update Targets when the task runs.
+	// TargetHosts are the hosts of the query in its order like sort_by, and the task runs on them in the order.
+	TargetsQuery *HostQuery
+	TargetHosts  []*Host
+	// Steps run in order instead of the task's script. Each step is a task that has its own backend and targets.
+	Steps []*Task
+	// StepOf is the task that runs the task as its step.
+	StepOf *Task
+	// Upload and Download are the files copied to and from each target host before and after the script.
+	Upload   []*FileTransfer
+	Download []*FileTransfer
 	// deprecated? use only hidden?
 	Disabled  bool
 	Hidden    bool
 	Prefix    string
 	UsePrefix bool
+	Output    string
+	// GroupOutput prints identical outputs of the hosts once after all hosts finished.
+	GroupOutput bool
+	// Capture makes the outputs available in the callbacks.
+	Capture bool
+	// Transport is the way to run the script on remote hosts. It overrides the host's transport.
+	Transport string
 	Registry  *Registry
 	Group     *Group
 	Args      []string
-	LValues   map[string]lua.LValue
-	Parent    *Task
-	Child     *Task
+	// Params are the declared parameters, and ParamValues are their values parsed from the command line arguments.
+	Params      []*TaskParam
+	ParamValues map[string]string
+	// RawArgs are the command line arguments including the parameters.
+	RawArgs []string
+	LValues map[string]lua.LValue
+	Parent  *Task
+	Child   *Task
+}
+
+// RetryPolicy decides whether the task's script is re-run on a host when it failed.
+type RetryPolicy struct {
+	// Attempts is the max number of runs including the first one.
+	Attempts    int
+	Delay       time.Duration
+	Backoff     float64
+	OnExitCodes []int
+	// MaxDelay caps the delay growing by Backoff.
+	MaxDelay time.Duration
+}
+
+// DefaultRetryMaxDelay is the max delay between retries if the retry policy doesn't set max_delay.
+const DefaultRetryMaxDelay = 5 * time.Minute
+
+func NewRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		Attempts: 1,
+		Delay:    0,
+		Backoff:  1.0,
+		// ssh exits with 255 when an error occurred in the connection.
+		OnExitCodes: []int{255},
+		MaxDelay:    DefaultRetryMaxDelay,
+	}
+}
+
+// NextDelay returns the delay before the next retry multiplied by the backoff and capped by the max delay.
+func (r *RetryPolicy) NextDelay(delay time.Duration) time.Duration {
+	next := time.Duration(float64(delay) * r.Backoff)
+	if next > r.MaxDelay {
+		return r.MaxDelay
+	}
+
+	return next
+}
+
+func (r *RetryPolicy) IsRetryableExitCode(code int) bool {
+	for _, c := range r.OnExitCodes {
+		if c == code {
+			return true
+		}
+	}
+
+	return false
 }
 
 var Tasks map[string]*Task
@@ -48,15 +144,40 @@ const (
 	TASK_BACKEND_REMOTE = "remote"
 )
 
+const (
+	TRANSPORT_SSH    = "ssh"
+	TRANSPORT_NATIVE = "native"
+)
+
+const (
+	TASK_OUTPUT_TEXT  = "text"
+	TASK_OUTPUT_JSONL = "jsonl"
+)
+
+const (
+	TASK_ON_ERROR_ABORT    = "abort"
+	TASK_ON_ERROR_CONTINUE = "continue"
+)
+
 func NewTask() *Task {
 	return &Task{
-		Targets: []string{},
-		Filters: []string{},
-		Backend: TASK_BACKEND_LOCAL,
-		SSHOptions: []string{},
-		Script:  []map[string]string{},
-		Args:    []string{},
-		LValues: map[string]lua.LValue{},
+		Targets:     []string{},
+		Filters:     []string{},
+		Depends:     []string{},
+		Backend:     TASK_BACKEND_LOCAL,
+		OnError:     TASK_ON_ERROR_ABORT,
+		Output:      TASK_OUTPUT_TEXT,
+		SSHOptions:  []string{},
+		Upload:      []*FileTransfer{},
+		Download:    []*FileTransfer{},
+		Script:      []map[string]string{},
+		Args:        []string{},
+		Env:         map[string]interface{}{},
+		Environ:     map[string]map[string]string{},
+		Params:      []*TaskParam{},
+		ParamValues: map[string]string{},
+		RawArgs:     []string{},
+		LValues:     map[string]lua.LValue{},
 	}
 }
 
@@ -94,6 +215,58 @@ func (t *Task) FiltersSlice() []string {
 	return []string{}
 }
 
+// BatchSizes returns the numbers of hosts in the batches for the total number of hosts.
+// The last size is used for the rest of the batches.
+func (t *Task) BatchSizes(total int) []int {
+	sizes, err := parseSerial(t.Serial, total)
+	if err != nil {
+		return []int{total}
+	}
+
+	return sizes
+}
+
+// parseSerial parses a number, a percentage like "20%" or a comma separated list of them like "1,20%" into the numbers of hosts.
+// A percentage is rounded up and is at least 1. An empty string means all hosts.
+func parseSerial(serial string, total int) ([]int, error) {
+	if serial == "" {
+		return []int{total}, nil
+	}
+
+	sizes := []int{}
+	for _, s := range strings.Split(serial, ",") {
+		size, err := parseSerialSize(strings.TrimSpace(s), total)
+		if err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, size)
+	}
+
+	return sizes, nil
+}
+
+func parseSerialSize(serial string, total int) (int, error) {
+	if strings.HasSuffix(serial, "%") {
+		percentage, err := strconv.ParseFloat(strings.TrimSuffix(serial, "%"), 64)
+		if err != nil || percentage <= 0 || percentage > 100 {
+			return 0, fmt.Errorf("invalid serial '%s'. it must be a percentage between 0%% and 100%%.", serial)
+		}
+
+		size := int(math.Ceil(float64(total) * percentage / 100))
+		if size < 1 {
+			size = 1
+		}
+		return size, nil
+	}
+
+	size, err := strconv.Atoi(serial)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid serial '%s'. it must be a positive number or a percentage like '20%%'.", serial)
+	}
+
+	return size, nil
+}
+
 func (t *Task) DescriptionOrDefault() string {
 	if t.Description == "" {
 		return t.Name + " task"
@@ -249,7 +422,17 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 			}
 		}
 	case "targets":
-		if targetsStr, ok := toString(value); ok {
+		task.TargetsQuery = nil
+		task.TargetHosts = nil
+		if ud, ok := value.(*lua.LUserData); ok {
+			hostQuery, ok := ud.Value.(*HostQuery)
+			if !ok {
+				panic("invalid value of a task's field '" + key + "'.")
+			}
+			task.TargetsQuery = hostQuery
+			task.TargetHosts = hostQuery.GetHostsInOrder()
+			task.Targets = hostNames(task.TargetHosts)
+		} else if targetsStr, ok := toString(value); ok {
 			task.Targets = []string{targetsStr}
 		} else if targetsSlice, ok := toSlice(value); ok {
 			task.Targets = []string{}
@@ -262,6 +445,52 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 		} else {
 			panic("invalid value of a task's field '" + key + "'.")
 		}
+		if err := ValidateSelectors(task.Targets); err != nil {
+			L.RaiseError("%v", err)
+		}
+	case "when":
+		var selections []string
+		if fn, ok := value.(*lua.LFunction); ok {
+			task.When = func(host *Host) (bool, error) {
+				err := L.CallByParam(lua.P{
+					Fn:      fn,
+					NRet:    1,
+					Protect: true,
+				}, newLHost(L, host))
+				if err != nil {
+					return false, err
+				}
+
+				ret := L.Get(-1)
+				L.Pop(1)
+
+				return lua.LVAsBool(ret), nil
+			}
+		} else if whenStr, ok := toString(value); ok {
+			selections = []string{whenStr}
+		} else if whenSlice, ok := toSlice(value); ok {
+			for _, when := range whenSlice {
+				if whenStr, ok := when.(string); ok {
+					selections = append(selections, whenStr)
+				}
+			}
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+
+		if err := ValidateSelectors(selections); err != nil {
+			L.RaiseError("%v", err)
+		}
+		if selections != nil {
+			task.When = func(host *Host) (bool, error) {
+				hosts := NewHostQuery().
+					SetDatasource(map[string]*Host{host.Name: host}).
+					AppendSelections(selections).
+					GetHosts()
+
+				return len(hosts) > 0, nil
+			}
+		}
 	case "filters":
 		if filtersStr, ok := toString(value); ok {
 			task.Filters = []string{filtersStr}
@@ -276,6 +505,25 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 		} else {
 			panic("invalid value of a task's field '" + key + "'.")
 		}
+		if err := ValidateSelectors(task.Filters); err != nil {
+			L.RaiseError("%v", err)
+		}
+	case "depends":
+		if dependsStr, ok := toString(value); ok {
+			task.Depends = []string{dependsStr}
+		} else if dependsSlice, ok := toSlice(value); ok {
+			task.Depends = []string{}
+
+			for _, depend := range dependsSlice {
+				dependStr, ok := depend.(string)
+				if !ok {
+					L.RaiseError("depends must be a task name or an array table of task names.")
+				}
+				task.Depends = append(task.Depends, dependStr)
+			}
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
 	case "description":
 		if descStr, ok := toString(value); ok {
 			task.Description = descStr
@@ -300,6 +548,132 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 		} else {
 			panic("invalid value of a task's field '" + key + "'.")
 		}
+	case "max_parallel":
+		if maxParallelNum, ok := toFloat64(value); ok {
+			if maxParallelNum < 0 {
+				L.RaiseError("max_parallel must be a positive number.")
+			}
+			task.MaxParallel = int(maxParallelNum)
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+	case "on_error":
+		if onErrorStr, ok := toString(value); ok {
+			task.OnError = onErrorStr
+			if onErrorStr != TASK_ON_ERROR_ABORT && onErrorStr != TASK_ON_ERROR_CONTINUE {
+				L.RaiseError("on_error must be '%s' or '%s'.", TASK_ON_ERROR_ABORT, TASK_ON_ERROR_CONTINUE)
+			}
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+	case "timeout":
+		if timeout, ok := toDuration(value); ok {
+			task.Timeout = timeout
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+	case "host_timeout":
+		if timeout, ok := toDuration(value); ok {
+			task.HostTimeout = timeout
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+	case "retry":
+		if attemptsNum, ok := toFloat64(value); ok {
+			task.Retry = NewRetryPolicy()
+			task.Retry.Attempts = int(attemptsNum)
+		} else if retryTb, ok := toLTable(value); ok {
+			task.Retry = NewRetryPolicy()
+			retryTb.ForEach(func(retryKey lua.LValue, retryValue lua.LValue) {
+				retryKeyStr, _ := toString(retryKey)
+				switch retryKeyStr {
+				case "attempts":
+					attemptsNum, ok := toFloat64(retryValue)
+					if !ok {
+						L.RaiseError("retry's attempts must be a number.")
+					}
+					task.Retry.Attempts = int(attemptsNum)
+				case "delay":
+					delay, ok := toDuration(retryValue)
+					if !ok {
+						L.RaiseError("retry's delay must be a duration like '5s' or a number of seconds.")
+					}
+					task.Retry.Delay = delay
+				case "backoff":
+					backoffNum, ok := toFloat64(retryValue)
+					if !ok || backoffNum < 1 {
+						L.RaiseError("retry's backoff must be a number greater than or equal to 1.")
+					}
+					task.Retry.Backoff = backoffNum
+				case "max_delay":
+					maxDelay, ok := toDuration(retryValue)
+					if !ok {
+						L.RaiseError("retry's max_delay must be a duration like '1m' or a number of seconds.")
+					}
+					task.Retry.MaxDelay = maxDelay
+				case "on_exit_codes":
+					codesTb, ok := toLTable(retryValue)
+					if !ok {
+						L.RaiseError("retry's on_exit_codes must be an array table of numbers.")
+					}
+					// the configured codes are added to 255 that is always retried as a connection error.
+					codesTb.ForEach(func(_ lua.LValue, codeValue lua.LValue) {
+						codeNum, ok := toFloat64(codeValue)
+						if !ok {
+							L.RaiseError("retry's on_exit_codes must be an array table of numbers.")
+						}
+						task.Retry.OnExitCodes = append(task.Retry.OnExitCodes, int(codeNum))
+					})
+				default:
+					L.RaiseError("unsupported retry's field '%v'.", retryKey)
+				}
+			})
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+
+		if task.Retry.Attempts < 1 {
+			L.RaiseError("retry's attempts must be greater than or equal to 1.")
+		}
+	case "serial":
+		if serialNum, ok := toFloat64(value); ok {
+			task.Serial = strconv.Itoa(int(serialNum))
+		} else if serialStr, ok := toString(value); ok {
+			task.Serial = serialStr
+		} else if serialSlice, ok := toSlice(value); ok {
+			sizes := []string{}
+			for _, size := range serialSlice {
+				switch v := size.(type) {
+				case float64:
+					sizes = append(sizes, strconv.Itoa(int(v)))
+				case string:
+					sizes = append(sizes, v)
+				default:
+					L.RaiseError("serial must be a number, a percentage or an array table of them.")
+				}
+			}
+			task.Serial = strings.Join(sizes, ",")
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+
+		if _, err := parseSerial(task.Serial, 1); err != nil {
+			L.RaiseError("%v", err)
+		}
+	case "batch_pause":
+		if confirmStr, ok := toString(value); ok && confirmStr == "confirm" {
+			task.BatchPauseConfirm = true
+		} else if pause, ok := toDuration(value); ok {
+			task.BatchPause = pause
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+	case "max_fail_percentage":
+		if percentageNum, ok := toFloat64(value); ok {
+			task.MaxFailPercentage = &percentageNum
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
 	case "user":
 		if userStr, ok := toString(value); ok {
 			task.User = userStr
@@ -321,6 +695,13 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 				}
 			}
 		}
+	case "upload", "download":
+		transfers := toFileTransfers(L, key, value)
+		if key == "upload" {
+			task.Upload = transfers
+		} else {
+			task.Download = transfers
+		}
 	case "disabled":
 		if disabledBool, ok := toBool(value); ok {
 			task.Disabled = disabledBool
@@ -343,6 +724,9 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 		if task.File != "" && len(task.Script) > 0 {
 			L.RaiseError("invalid task definition: can't use 'script_file' and 'script' at the same time.")
 		}
+		if len(task.Steps) > 0 && len(task.Script) > 0 {
+			L.RaiseError("invalid task definition: can't use 'steps' and 'script' at the same time.")
+		}
 	case "script_file":
 		if fileStr, ok := toString(value); ok {
 			task.File = fileStr
@@ -353,6 +737,14 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 		if task.File != "" && len(task.Script) > 0 {
 			L.RaiseError("invalid task definition: can't use 'script_file' and 'script' at the same time.")
 		}
+		if len(task.Steps) > 0 && task.File != "" {
+			L.RaiseError("invalid task definition: can't use 'steps' and 'script_file' at the same time.")
+		}
+	case "steps":
+		task.Steps = toSteps(L, task, value)
+		if len(task.Steps) > 0 && (len(task.Script) > 0 || task.File != "") {
+			L.RaiseError("invalid task definition: can't use 'steps' and 'script' at the same time.")
+		}
 	case "prefix":
 		if prefixBool, ok := toBool(value); ok {
 			task.UsePrefix = prefixBool
@@ -362,6 +754,30 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 		} else {
 			panic("invalid value of a task's field '" + key + "'.")
 		}
+	case "output":
+		if outputStr, ok := toString(value); ok {
+			task.Output = outputStr
+			if outputStr != TASK_OUTPUT_TEXT && outputStr != TASK_OUTPUT_JSONL {
+				L.RaiseError("output must be '%s' or '%s'.", TASK_OUTPUT_TEXT, TASK_OUTPUT_JSONL)
+			}
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+	case "group_output":
+		if groupOutputBool, ok := toBool(value); ok {
+			task.GroupOutput = groupOutputBool
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+	case "transport":
+		if transportStr, ok := toString(value); ok {
+			task.Transport = transportStr
+			if transportStr != TRANSPORT_SSH && transportStr != TRANSPORT_NATIVE {
+				L.RaiseError("transport must be '%s' or '%s'.", TRANSPORT_SSH, TRANSPORT_NATIVE)
+			}
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
 	case "prepare":
 		if prepareFn, ok := value.(*lua.LFunction); ok {
 			task.Prepare = func() error {
@@ -392,6 +808,39 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 		} else {
 			L.RaiseError("prepare have to be a function.")
 		}
+	case "on_success", "on_failure", "finally":
+		fn, ok := value.(*lua.LFunction)
+		if !ok {
+			L.RaiseError("%s have to be a function.", key)
+		}
+		callback := func(results []*HostResult, err error) error {
+			lerr := lua.LValue(lua.LNil)
+			if err != nil {
+				lerr = lua.LString(err.Error())
+			}
+
+			return L.CallByParam(lua.P{
+				Fn:      fn,
+				NRet:    0,
+				Protect: true,
+			}, newLTask(L, task), newLHostResults(L, results, task.Capture), lerr)
+		}
+		switch key {
+		case "on_success":
+			task.OnSuccess = callback
+		case "on_failure":
+			task.OnFailure = callback
+		default:
+			task.Finally = callback
+		}
+	case "capture":
+		if captureBool, ok := toBool(value); ok {
+			task.Capture = captureBool
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+	case "env":
+		task.Env = toEnv(L, value)
 	case "props":
 		if propsTb, ok := toLTable(value); ok {
 			// initialize
@@ -424,11 +873,185 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 		} else {
 			panic("invalid value of a task's field '" + key + "'.")
 		}
+	case "params":
+		task.Params = toTaskParams(L, value)
+	case "param_values":
+		if valuesTb, ok := toLTable(value); ok {
+			task.ParamValues = map[string]string{}
+			valuesTb.ForEach(func(k lua.LValue, v lua.LValue) {
+				name, ok := toString(k)
+				if !ok {
+					L.RaiseError("param_values table's key must be a string: %v", k)
+				}
+				if _, ok := v.(*lua.LTable); ok {
+					L.RaiseError("param_values table's value must not be a table: %s", name)
+				}
+				task.ParamValues[name] = v.String()
+			})
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
 	default:
 		panic("unsupported task's field '" + key + "'.")
 	}
 }
 
+// toSteps converts an array of tables that have the fields of a task to the step tasks.
+// A step can have `name` that is used in the step task's name like "deploy/build".
+func toSteps(L *lua.LState, task *Task, value lua.LValue) []*Task {
+	tb, ok := toLTable(value)
+	if !ok {
+		panic("invalid value of a task's field 'steps'.")
+	}
+
+	steps := []*Task{}
+	for i := 1; i <= tb.MaxN(); i++ {
+		entry, ok := toLTable(tb.RawGetInt(i))
+		if !ok {
+			L.RaiseError("steps's entry must be a table.")
+		}
+
+		step := NewTask()
+		step.Name = fmt.Sprintf("%s/%d", task.Name, i)
+		entry.ForEach(func(k lua.LValue, v lua.LValue) {
+			ks, ok := toString(k)
+			if !ok {
+				return
+			}
+
+			switch ks {
+			case "name":
+				name, ok := toString(v)
+				if !ok {
+					L.RaiseError("step's name must be a string.")
+				}
+				step.Name = task.Name + "/" + name
+			case "steps", "depends", "prepare", "on_success", "on_failure", "finally", "params":
+				L.RaiseError("step doesn't support '%s'.", ks)
+			default:
+				updateTask(L, step, ks, v)
+			}
+		})
+		steps = append(steps, step)
+	}
+
+	return steps
+}
+
+// Step returns the step that has the name, or nil if the task doesn't have it.
+func (t *Task) Step(name string) *Task {
+	for _, step := range t.Steps {
+		if step.Name == t.Name+"/"+name {
+			return step
+		}
+	}
+
+	return nil
+}
+
+// StepName returns the name of the step without the prefix of the parent task's name.
+func (t *Task) StepName() string {
+	if t.StepOf == nil {
+		return ""
+	}
+
+	return strings.TrimPrefix(t.Name, t.StepOf.Name+"/")
+}
+
+// newStepTask returns a task to run the step of the parent task.
+// The step inherits the arguments and the parameters, and the parent's settings that it doesn't have.
+func newStepTask(parent *Task, step *Task) *Task {
+	t := *step
+	t.StepOf = parent
+	t.Registry = parent.Registry
+	t.Group = parent.Group
+	t.Props = parent.Props
+	t.Args = parent.Args
+	t.ParamValues = parent.ParamValues
+	t.RawArgs = parent.RawArgs
+
+	inherit := func(key string, set func()) {
+		if _, ok := step.LValues[key]; !ok {
+			set()
+		}
+	}
+	t.Env = map[string]interface{}{}
+	for key, value := range parent.Env {
+		t.Env[key] = value
+	}
+	for key, value := range step.Env {
+		t.Env[key] = value
+	}
+
+	inherit("driver", func() { t.Driver = parent.Driver })
+	inherit("output", func() { t.Output = parent.Output })
+	inherit("group_output", func() { t.GroupOutput = parent.GroupOutput })
+	inherit("prefix", func() { t.UsePrefix, t.Prefix = parent.UsePrefix, parent.Prefix })
+	inherit("transport", func() { t.Transport = parent.Transport })
+	inherit("ssh_options", func() { t.SSHOptions = parent.SSHOptions })
+	inherit("on_error", func() { t.OnError = parent.OnError })
+	inherit("capture", func() { t.Capture = parent.Capture })
+
+	return &t
+}
+
+// toFileTransfers converts a table like { src = "...", dest = "..." } or an array of the tables.
+func toFileTransfers(L *lua.LState, key string, value lua.LValue) []*FileTransfer {
+	tb, ok := toLTable(value)
+	if !ok {
+		panic("invalid value of a task's field '" + key + "'.")
+	}
+
+	entries := []*lua.LTable{}
+	if tb.RawGetString("src") != lua.LNil {
+		entries = append(entries, tb)
+	} else {
+		for i := 1; i <= tb.MaxN(); i++ {
+			entry, ok := toLTable(tb.RawGetInt(i))
+			if !ok {
+				L.RaiseError("%s's entry must be a table that has 'src' and 'dest'.", key)
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	transfers := []*FileTransfer{}
+	for _, entry := range entries {
+		t := &FileTransfer{}
+		entry.ForEach(func(k lua.LValue, v lua.LValue) {
+			ks, _ := toString(k)
+			vs, ok := toString(v)
+			if !ok {
+				L.RaiseError("%s's %s must be a string.", key, ks)
+			}
+
+			switch ks {
+			case "src":
+				t.Src = vs
+			case "dest":
+				t.Dest = vs
+			case "mode":
+				if key != "upload" {
+					L.RaiseError("%s doesn't support mode.", key)
+				}
+				if _, err := strconv.ParseUint(vs, 8, 32); err != nil {
+					L.RaiseError("%s's mode must be an octal string like '0644'.", key)
+				}
+				t.Mode = vs
+			default:
+				L.RaiseError("unsupported %s's field '%s'.", key, ks)
+			}
+		})
+
+		if t.Src == "" || t.Dest == "" {
+			L.RaiseError("%s requires 'src' and 'dest'.", key)
+		}
+		transfers = append(transfers, t)
+	}
+
+	return transfers
+}
+
 func toScript(L *lua.LState, value lua.LValue) ([]map[string]string, error) {
 	ret := []map[string]string{}
 
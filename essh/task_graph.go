@@ -0,0 +1,258 @@
+package essh
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// taskScheduler runs tasks with their dependencies.
+// Every task runs at most once per invocation and independent dependencies run concurrently.
+type taskScheduler struct {
+	config string
+	L      *lua.LState
+	// luaMutex serializes accesses to the lua state from the concurrent tasks.
+	luaMutex *sync.Mutex
+	mutex    *sync.Mutex
+	runs     map[string]*taskRun
+	// capture keeps the outputs of the task run by the user in this run, without changing the task's capture.
+	capture bool
+}
+
+type taskRun struct {
+	once    sync.Once
+	err     error
+	results []*HostResult
+}
+
+func newTaskScheduler(config string, L *lua.LState) *taskScheduler {
+	return &taskScheduler{
+		config:   config,
+		L:        L,
+		luaMutex: new(sync.Mutex),
+		mutex:    new(sync.Mutex),
+		runs:     map[string]*taskRun{},
+	}
+}
+
+func (s *taskScheduler) run(task *Task, args []string) error {
+	return s.runTask(task, args, true)
+}
+
+// runTask runs the task once. Only the task run by the user (root) reads stdin,
+// because the dependencies run concurrently and stdin can't be shared among them.
+func (s *taskScheduler) runTask(task *Task, args []string, root bool) error {
+	s.mutex.Lock()
+	r, ok := s.runs[task.Name]
+	if !ok {
+		r = &taskRun{}
+		s.runs[task.Name] = r
+	}
+	s.mutex.Unlock()
+
+	r.once.Do(func() {
+		if err := s.runDepends(task); err != nil {
+			r.err = err
+			return
+		}
+
+		r.results, r.err = s.execute(task, args, root)
+	})
+
+	return r.err
+}
+
+func (s *taskScheduler) runDepends(task *Task) error {
+	if len(task.Depends) == 0 {
+		return nil
+	}
+
+	depends := []*Task{}
+	for _, name := range task.Depends {
+		dep := GetEnabledTask(name)
+		if dep == nil {
+			return fmt.Errorf("task '%s' depends on undefined or disabled task '%s'.", task.Name, name)
+		}
+		depends = append(depends, dep)
+	}
+
+	if debugFlag {
+		fmt.Printf("[essh debug] run task's dependencies: %v\n", task.Depends)
+	}
+
+	errs := make([]error, len(depends))
+	wg := &sync.WaitGroup{}
+	for i, dep := range depends {
+		wg.Add(1)
+		go func(i int, dep *Task) {
+			defer wg.Done()
+			errs[i] = s.runTask(dep, []string{}, false)
+		}(i, dep)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *taskScheduler) execute(task *Task, args []string, root bool) ([]*HostResult, error) {
+	startRunningTask(task.Name)
+	defer finishRunningTask(task.Name)
+
+	s.luaMutex.Lock()
+	err := prepareTask(task, args, s.L)
+	if err == nil {
+		err = prepareTaskContents(s.config, task)
+	}
+	s.luaMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*HostResult
+	if len(task.Steps) > 0 {
+		results, err = s.executeSteps(task, root)
+	} else {
+		scriptTask := task
+		if root && s.capture {
+			t := *task
+			t.Capture = true
+			scriptTask = &t
+		}
+		results, err = runTaskScripts(s.config, scriptTask, root)
+	}
+
+	s.luaMutex.Lock()
+	defer s.luaMutex.Unlock()
+
+	return results, finishTask(task, results, err)
+}
+
+// executeSteps runs the task's steps in order, and stops at the first failed step.
+// It returns the results of all steps that ran.
+func (s *taskScheduler) executeSteps(task *Task, root bool) ([]*HostResult, error) {
+	results := []*HostResult{}
+	for i, step := range task.Steps {
+		if debugFlag {
+			fmt.Printf("[essh debug] run step %d/%d: %s\n", i+1, len(task.Steps), step.Name)
+		}
+
+		stepTask := newStepTask(task, step)
+		if root && s.capture {
+			stepTask.Capture = true
+		}
+
+		s.luaMutex.Lock()
+		err := resolveTaskTargets(stepTask, s.L)
+		if err == nil {
+			err = prepareTaskHosts(stepTask, s.L)
+		}
+		if err == nil {
+			err = prepareTaskContents(s.config, stepTask)
+		}
+		s.luaMutex.Unlock()
+		if err != nil {
+			return results, err
+		}
+
+		stepResults, err := runTaskScripts(s.config, stepTask, root)
+		results = append(results, stepResults...)
+		if err != nil {
+			return results, fmt.Errorf("step '%s' failed: %w", stepTask.Name, err)
+		}
+	}
+
+	return results, nil
+}
+
+// runningTasks counts the running tasks by the names to detect a task that runs itself by essh.run_task.
+var runningTasks = map[string]int{}
+var runningTasksMutex = new(sync.Mutex)
+
+func startRunningTask(name string) {
+	runningTasksMutex.Lock()
+	defer runningTasksMutex.Unlock()
+
+	runningTasks[name]++
+}
+
+func finishRunningTask(name string) {
+	runningTasksMutex.Lock()
+	defer runningTasksMutex.Unlock()
+
+	if runningTasks[name]--; runningTasks[name] <= 0 {
+		delete(runningTasks, name)
+	}
+}
+
+func isRunningTask(name string) bool {
+	runningTasksMutex.Lock()
+	defer runningTasksMutex.Unlock()
+
+	return runningTasks[name] > 0
+}
+
+// findTaskDependencyCycle returns task names that form a dependency cycle, or nil if there is no cycle.
+func findTaskDependencyCycle(tasks map[string]*Task) []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	states := map[string]int{}
+	path := []string{}
+
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		switch states[name] {
+		case visiting:
+			for i, n := range path {
+				if n == name {
+					cycle := append([]string{}, path[i:]...)
+					return append(cycle, name)
+				}
+			}
+		case visited:
+			return nil
+		}
+
+		task := tasks[name]
+		if task == nil {
+			return nil
+		}
+
+		states[name] = visiting
+		path = append(path, name)
+		for _, dep := range task.Depends {
+			if cycle := visit(dep); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		states[name] = visited
+
+		return nil
+	}
+
+	names := []string{}
+	for name := range tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if cycle := visit(name); cycle != nil {
+			return cycle
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package essh
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func newTestDependTasks(depends map[string][]string) map[string]*Task {
+	tasks := map[string]*Task{}
+	for name, deps := range depends {
+		task := NewTask()
+		task.Name = name
+		task.Depends = deps
+		tasks[name] = task
+	}
+
+	return tasks
+}
+
+func TestFindTaskDependencyCycle(t *testing.T) {
+	cases := []struct {
+		desc    string
+		depends map[string][]string
+		cycle   []string
+	}{
+		{
+			desc:    "no dependencies",
+			depends: map[string][]string{"a": nil, "b": nil},
+		},
+		{
+			desc:    "chain",
+			depends: map[string][]string{"a": {"b"}, "b": {"c"}, "c": nil},
+		},
+		{
+			desc:    "diamond",
+			depends: map[string][]string{"a": {"b", "c"}, "b": {"d"}, "c": {"d"}, "d": nil},
+		},
+		{
+			desc:    "self dependency",
+			depends: map[string][]string{"a": {"a"}},
+			cycle:   []string{"a", "a"},
+		},
+		{
+			desc:    "cycle",
+			depends: map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"a"}},
+			cycle:   []string{"a", "b", "c", "a"},
+		},
+		{
+			desc:    "cycle under a task without cycle",
+			depends: map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"b"}},
+			cycle:   []string{"b", "c", "b"},
+		},
+		{
+			desc:    "unknown dependency is not a cycle",
+			depends: map[string][]string{"a": {"unknown"}},
+		},
+	}
+
+	for _, c := range cases {
+		cycle := findTaskDependencyCycle(newTestDependTasks(c.depends))
+		if !reflect.DeepEqual(cycle, c.cycle) {
+			t.Errorf("%s: expected %v, but got %v", c.desc, c.cycle, cycle)
+		}
+	}
+}
+
+func TestValidateTaskDependencies(t *testing.T) {
+	cases := []struct {
+		desc    string
+		depends map[string][]string
+		err     string
+	}{
+		{
+			desc:    "valid",
+			depends: map[string][]string{"a": {"b", "c"}, "b": {"c"}, "c": nil},
+		},
+		{
+			desc:    "unknown dependency",
+			depends: map[string][]string{"a": {"b"}, "b": {"unknown"}},
+			err:     "Task 'b' depends on undefined task 'unknown'.",
+		},
+		{
+			desc:    "self dependency",
+			depends: map[string][]string{"a": {"a"}},
+			err:     "Task dependencies have a cycle: a -> a.",
+		},
+		{
+			desc:    "cycle",
+			depends: map[string][]string{"a": {"b"}, "b": {"a"}},
+			err:     "Task dependencies have a cycle: a -> b -> a.",
+		},
+	}
+
+	for _, c := range cases {
+		err := validateResources(newTestDependTasks(c.depends), map[string]*Host{})
+		if c.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", c.desc, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%s: expected the error '%s', but got %v", c.desc, c.err, err)
+		}
+	}
+}
+
+const testDependTasksConfig = `
+local function log(name)
+    return "echo " .. name .. " >> $DIR/log"
+end
+task "a" { backend = "local", script = log("a") }
+task "b" { backend = "local", depends = "a", script = "sleep 0.1; " .. log("b") }
+task "c" { backend = "local", depends = "a", script = log("c") }
+task "d" { backend = "local", depends = {"b", "c"}, script = log("d") }
+task "fail" { backend = "local", depends = "a", script = "exit 1" }
+task "after-fail" { backend = "local", depends = {"fail", "c"}, script = log("after-fail") }
+`
+
+func TestTaskSchedulerRunsDependencies(t *testing.T) {
+	cases := []struct {
+		task    string
+		success bool
+		// the order of the tasks in the same group isn't decided.
+		groups [][]string
+	}{
+		{task: "a", success: true, groups: [][]string{{"a"}}},
+		{task: "b", success: true, groups: [][]string{{"a"}, {"b"}}},
+		{task: "d", success: true, groups: [][]string{{"a"}, {"b", "c"}, {"d"}}},
+		{task: "after-fail", success: false, groups: [][]string{{"a"}, {"c"}}},
+	}
+
+	for _, c := range cases {
+		status, dir := runTestConfig(t, testDependTasksConfig, c.task)
+		if (status == 0) != c.success {
+			t.Errorf("%s: expected the success %v, but got the exit status %d", c.task, c.success, status)
+		}
+
+		b, _ := os.ReadFile(filepath.Join(dir, "log"))
+		ran := strings.Fields(string(b))
+		if !matchTaskGroups(ran, c.groups) {
+			t.Errorf("%s: expected %v, but ran %v", c.task, c.groups, ran)
+		}
+	}
+}
+
+// matchTaskGroups returns true if the tasks ran in the order of the groups. The tasks in a group run in any order.
+func matchTaskGroups(ran []string, groups [][]string) bool {
+	i := 0
+	for _, group := range groups {
+		if i+len(group) > len(ran) {
+			return false
+		}
+		got := append([]string{}, ran[i:i+len(group)]...)
+		want := append([]string{}, group...)
+		sort.Strings(got)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			return false
+		}
+		i += len(group)
+	}
+
+	return i == len(ran)
+}
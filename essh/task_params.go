@@ -0,0 +1,312 @@
+package essh
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sevir/essh/support/helper"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// TaskParam is a parameter of a task that is passed by a command line option like `--name value`.
+type TaskParam struct {
+	Name        string
+	Type        string
+	Default     string
+	HasDefault  bool
+	Required    bool
+	Choices     []string
+	Description string
+}
+
+const (
+	TASK_PARAM_TYPE_STRING  = "string"
+	TASK_PARAM_TYPE_NUMBER  = "number"
+	TASK_PARAM_TYPE_BOOLEAN = "boolean"
+)
+
+var taskParamNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+
+// validate checks that the value is valid for the param's type and choices.
+func (p *TaskParam) validate(value string) error {
+	switch p.Type {
+	case TASK_PARAM_TYPE_NUMBER:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("parameter '--%s' must be a number: %s", p.Name, value)
+		}
+	case TASK_PARAM_TYPE_BOOLEAN:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("parameter '--%s' must be a boolean: %s", p.Name, value)
+		}
+	}
+
+	if len(p.Choices) > 0 {
+		for _, c := range p.Choices {
+			if c == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("parameter '--%s' must be one of %s: %s", p.Name, strings.Join(p.Choices, ", "), value)
+	}
+
+	return nil
+}
+
+// toLValue converts the value to a lua value by the param's type.
+func (p *TaskParam) toLValue(value string) lua.LValue {
+	switch p.Type {
+	case TASK_PARAM_TYPE_NUMBER:
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return lua.LNumber(f)
+		}
+	case TASK_PARAM_TYPE_BOOLEAN:
+		if b, err := strconv.ParseBool(value); err == nil {
+			return lua.LBool(b)
+		}
+	}
+
+	return lua.LString(value)
+}
+
+// usage returns the option form of the param like `--name <string>`.
+func (p *TaskParam) usage() string {
+	if p.Type == TASK_PARAM_TYPE_BOOLEAN {
+		return "--" + p.Name
+	}
+
+	return "--" + p.Name + " <" + p.Type + ">"
+}
+
+func (t *Task) Param(name string) *TaskParam {
+	for _, p := range t.Params {
+		if p.Name == name {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// parseTaskParams parses the parameters of the task in the args.
+// It returns the values of the parameters and the rest positional args.
+// Options like `--name value`, `--name=value` and `--no-name` for a boolean are supported.
+func parseTaskParams(task *Task, args []string) (map[string]string, []string, error) {
+	values := map[string]string{}
+	rest := []string{}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i+1:]...)
+			break
+		}
+
+		if !strings.HasPrefix(arg, "--") {
+			rest = append(rest, arg)
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(arg[2:], "=")
+		p := task.Param(name)
+		if p == nil && !hasValue && strings.HasPrefix(name, "no-") {
+			if np := task.Param(name[3:]); np != nil && np.Type == TASK_PARAM_TYPE_BOOLEAN {
+				p, value, hasValue = np, "false", true
+			}
+		}
+		if p == nil {
+			return nil, nil, fmt.Errorf("task '%s' doesn't have the parameter '%s'. see 'essh %s --help'", task.Name, arg, task.Name)
+		}
+
+		if !hasValue {
+			if p.Type == TASK_PARAM_TYPE_BOOLEAN {
+				value = "true"
+			} else if i+1 < len(args) {
+				value = args[i+1]
+				i++
+			} else {
+				return nil, nil, fmt.Errorf("parameter '--%s' requires a value.", p.Name)
+			}
+		}
+
+		if err := p.validate(value); err != nil {
+			return nil, nil, err
+		}
+		values[p.Name] = value
+	}
+
+	for _, p := range task.Params {
+		if _, ok := values[p.Name]; ok {
+			continue
+		}
+		if p.HasDefault {
+			values[p.Name] = p.Default
+		} else if p.Required {
+			return nil, nil, fmt.Errorf("task '%s' requires the parameter '--%s'.", task.Name, p.Name)
+		}
+	}
+
+	return values, rest, nil
+}
+
+// hasTaskHelpOption returns true if the task's args have `--help` before `--`.
+func hasTaskHelpOption(args []string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			return false
+		} else if arg == "--help" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func printTaskHelp(w io.Writer, task *Task) {
+	usage := "essh " + task.PublicName()
+	for _, p := range task.Params {
+		if p.Required {
+			usage += " " + p.usage()
+		} else {
+			usage += " [" + p.usage() + "]"
+		}
+	}
+	fmt.Fprintf(w, "Usage: %s [args...]\n", usage)
+
+	if task.Description != "" {
+		fmt.Fprintf(w, "\n%s\n", task.Description)
+	}
+
+	if len(task.Params) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "\nParameters:\n")
+	tb := helper.NewPlainTable(w)
+	for _, p := range task.Params {
+		desc := p.Description
+		if p.Required {
+			desc = strings.TrimSpace("(required) " + desc)
+		}
+		if len(p.Choices) > 0 {
+			desc = strings.TrimSpace(desc + " [choices: " + strings.Join(p.Choices, ", ") + "]")
+		}
+		if p.HasDefault {
+			desc = strings.TrimSpace(desc + " [default: " + p.Default + "]")
+		}
+		tb.Append([]string{p.usage(), desc})
+	}
+	tb.Render()
+}
+
+// toTaskParams converts an array of tables that have `name` or a table keyed by the names.
+func toTaskParams(L *lua.LState, value lua.LValue) []*TaskParam {
+	tb, ok := toLTable(value)
+	if !ok {
+		L.RaiseError("params must be a table.")
+	}
+
+	entries := []*lua.LTable{}
+	names := []string{}
+	if tb.MaxN() > 0 {
+		for i := 1; i <= tb.MaxN(); i++ {
+			entry, ok := toLTable(tb.RawGetInt(i))
+			if !ok {
+				L.RaiseError("params's entry must be a table that has 'name'.")
+			}
+			name, ok := toString(entry.RawGetString("name"))
+			if !ok {
+				L.RaiseError("params's entry must have 'name'.")
+			}
+			entries = append(entries, entry)
+			names = append(names, name)
+		}
+	} else {
+		byName := map[string]*lua.LTable{}
+		tb.ForEach(func(k lua.LValue, v lua.LValue) {
+			name, ok := toString(k)
+			if !ok {
+				L.RaiseError("params table's key must be a string: %v", k)
+			}
+			entry, ok := toLTable(v)
+			if !ok {
+				L.RaiseError("params's entry must be a table: %s", name)
+			}
+			byName[name] = entry
+			names = append(names, name)
+		})
+		sort.Strings(names)
+		for _, name := range names {
+			entries = append(entries, byName[name])
+		}
+	}
+
+	params := []*TaskParam{}
+	for i, entry := range entries {
+		p := &TaskParam{Name: names[i], Type: TASK_PARAM_TYPE_STRING}
+		if !taskParamNameRegexp.MatchString(p.Name) {
+			L.RaiseError("invalid parameter name '%s'.", p.Name)
+		}
+		if isEsshOption(p.Name) {
+			L.RaiseError("parameter '%s' can't be used, because '--%s' is an option of essh.", p.Name, p.Name)
+		}
+
+		var defaultValue lua.LValue = lua.LNil
+		entry.ForEach(func(k lua.LValue, v lua.LValue) {
+			ks, _ := toString(k)
+			switch ks {
+			case "name":
+			case "type":
+				typ, ok := toString(v)
+				if !ok || (typ != TASK_PARAM_TYPE_STRING && typ != TASK_PARAM_TYPE_NUMBER && typ != TASK_PARAM_TYPE_BOOLEAN) {
+					L.RaiseError("parameter '%s' has invalid type %v. It must be 'string', 'number' or 'boolean'.", p.Name, v)
+				}
+				p.Type = typ
+			case "default":
+				defaultValue = v
+			case "required":
+				required, ok := toBool(v)
+				if !ok {
+					L.RaiseError("parameter '%s''s required must be a boolean.", p.Name)
+				}
+				p.Required = required
+			case "choices":
+				choices, ok := toLTable(v)
+				if !ok {
+					L.RaiseError("parameter '%s''s choices must be a table.", p.Name)
+				}
+				choices.ForEach(func(_ lua.LValue, c lua.LValue) {
+					if _, ok := c.(*lua.LTable); ok {
+						L.RaiseError("parameter '%s''s choices must be strings or numbers.", p.Name)
+					}
+					p.Choices = append(p.Choices, c.String())
+				})
+			case "description":
+				desc, ok := toString(v)
+				if !ok {
+					L.RaiseError("parameter '%s''s description must be a string.", p.Name)
+				}
+				p.Description = desc
+			default:
+				L.RaiseError("unsupported parameter's field '%s'.", ks)
+			}
+		})
+
+		if defaultValue != lua.LNil {
+			p.Default, p.HasDefault = defaultValue.String(), true
+			if err := p.validate(p.Default); err != nil {
+				L.RaiseError("invalid default value: %v", err)
+			}
+		}
+		if p.Type == TASK_PARAM_TYPE_BOOLEAN && !p.HasDefault {
+			p.Default, p.HasDefault = "false", true
+		}
+
+		params = append(params, p)
+	}
+
+	return params
+}
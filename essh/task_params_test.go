@@ -0,0 +1,158 @@
+package essh
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func newTestParamsTask() *Task {
+	task := NewTask()
+	task.Name = "deploy"
+	task.Params = []*TaskParam{
+		{Name: "version", Type: TASK_PARAM_TYPE_STRING, Required: true},
+		{Name: "count", Type: TASK_PARAM_TYPE_NUMBER, Default: "1", HasDefault: true},
+		{Name: "force", Type: TASK_PARAM_TYPE_BOOLEAN, Default: "false", HasDefault: true},
+		{Name: "stage", Type: TASK_PARAM_TYPE_STRING, Choices: []string{"staging", "production"}},
+	}
+
+	return task
+}
+
+func TestParseTaskParams(t *testing.T) {
+	cases := []struct {
+		desc   string
+		args   []string
+		values map[string]string
+		rest   []string
+		err    string
+	}{
+		{
+			desc:   "separated value",
+			args:   []string{"--version", "1.2"},
+			values: map[string]string{"version": "1.2", "count": "1", "force": "false"},
+			rest:   []string{},
+		},
+		{
+			desc:   "joined value",
+			args:   []string{"--version=1.2", "--count=3"},
+			values: map[string]string{"version": "1.2", "count": "3", "force": "false"},
+			rest:   []string{},
+		},
+		{
+			desc:   "joined value that has '='",
+			args:   []string{"--version=a=b"},
+			values: map[string]string{"version": "a=b", "count": "1", "force": "false"},
+			rest:   []string{},
+		},
+		{
+			desc:   "boolean without value",
+			args:   []string{"--version", "1.2", "--force"},
+			values: map[string]string{"version": "1.2", "count": "1", "force": "true"},
+			rest:   []string{},
+		},
+		{
+			desc:   "negated boolean",
+			args:   []string{"--force", "--no-force", "--version", "1.2"},
+			values: map[string]string{"version": "1.2", "count": "1", "force": "false"},
+			rest:   []string{},
+		},
+		{
+			desc:   "boolean with value",
+			args:   []string{"--version", "1.2", "--force=true"},
+			values: map[string]string{"version": "1.2", "count": "1", "force": "true"},
+			rest:   []string{},
+		},
+		{
+			desc:   "choice",
+			args:   []string{"--version", "1.2", "--stage", "staging"},
+			values: map[string]string{"version": "1.2", "count": "1", "force": "false", "stage": "staging"},
+			rest:   []string{},
+		},
+		{
+			desc:   "positional args",
+			args:   []string{"a", "--version", "1.2", "b", "--", "--count", "c"},
+			values: map[string]string{"version": "1.2", "count": "1", "force": "false"},
+			rest:   []string{"a", "b", "--count", "c"},
+		},
+		{
+			desc: "unknown param",
+			args: []string{"--version", "1.2", "--unknown"},
+			err:  "doesn't have the parameter '--unknown'",
+		},
+		{
+			desc: "negated non boolean param",
+			args: []string{"--version", "1.2", "--no-count"},
+			err:  "doesn't have the parameter '--no-count'",
+		},
+		{
+			desc: "missing required param",
+			args: []string{"--count", "2"},
+			err:  "requires the parameter '--version'",
+		},
+		{
+			desc: "missing value",
+			args: []string{"--version"},
+			err:  "'--version' requires a value",
+		},
+		{
+			desc: "invalid number",
+			args: []string{"--version", "1.2", "--count", "many"},
+			err:  "'--count' must be a number",
+		},
+		{
+			desc: "invalid boolean",
+			args: []string{"--version", "1.2", "--force=maybe"},
+			err:  "'--force' must be a boolean",
+		},
+		{
+			desc: "invalid choice",
+			args: []string{"--version", "1.2", "--stage", "dev"},
+			err:  "'--stage' must be one of staging, production",
+		},
+	}
+
+	for _, c := range cases {
+		values, rest, err := parseTaskParams(newTestParamsTask(), c.args)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expected the error '%s', but got %v", c.desc, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(values, c.values) {
+			t.Errorf("%s: expected values %v, but got %v", c.desc, c.values, values)
+		}
+		if !reflect.DeepEqual(rest, c.rest) {
+			t.Errorf("%s: expected rest %v, but got %v", c.desc, c.rest, rest)
+		}
+	}
+}
+
+func TestTaskParamToLValue(t *testing.T) {
+	cases := []struct {
+		typ      string
+		value    string
+		expected lua.LValue
+	}{
+		{typ: TASK_PARAM_TYPE_STRING, value: "10", expected: lua.LString("10")},
+		{typ: TASK_PARAM_TYPE_NUMBER, value: "10", expected: lua.LNumber(10)},
+		{typ: TASK_PARAM_TYPE_NUMBER, value: "1.5", expected: lua.LNumber(1.5)},
+		{typ: TASK_PARAM_TYPE_BOOLEAN, value: "true", expected: lua.LTrue},
+		{typ: TASK_PARAM_TYPE_BOOLEAN, value: "false", expected: lua.LFalse},
+		{typ: TASK_PARAM_TYPE_BOOLEAN, value: "1", expected: lua.LTrue},
+	}
+
+	for _, c := range cases {
+		p := &TaskParam{Name: "p", Type: c.typ}
+		if v := p.toLValue(c.value); v != c.expected {
+			t.Errorf("%s '%s': expected %v (%s), but got %v (%s)", c.typ, c.value, c.expected, c.expected.Type(), v, v.Type())
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package essh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/Songmu/wrapcommander"
+	"github.com/sevir/essh/support/helper"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// HostResult is a result of running task's script on a host.
+// Host is nil when a local task runs without target hosts.
+type HostResult struct {
+	Host     *Host
+	ExitCode int
+	Duration time.Duration
+	Err      error
+	// Aborted is true if the script didn't run because of a failure on other hosts.
+	Aborted  bool
+	TimedOut bool
+	// Skipped is true if the host was excluded by the task's when.
+	Skipped bool
+	// Script is the script that was actually run on the host.
+	Script string
+	// Stdout and Stderr are the captured outputs. They are truncated by outputCaptureLimit.
+	Stdout []byte
+	Stderr []byte
+	// Output is the combined outputs to be grouped. It is used only in the group output mode.
+	Output []byte
+}
+
+func (r *HostResult) HostName() string {
+	if r.Host == nil {
+		return "local"
+	}
+
+	return r.Host.Name
+}
+
+func (r *HostResult) Failed() bool {
+	return r.Err != nil
+}
+
+func (r *HostResult) Status() string {
+	if r.Skipped {
+		return "skipped"
+	} else if r.Aborted {
+		return "aborted"
+	} else if r.TimedOut {
+		return "timed out"
+	} else if r.Failed() {
+		return "failed"
+	}
+
+	return "ok"
+}
+
+// runHost calls fn with a context that is canceled after the timeout, and returns the result.
+// fn can record the script and the outputs to the result.
+func runHost(ctx context.Context, host *Host, timeout time.Duration, fn func(ctx context.Context, r *HostResult) error) *HostResult {
+	if ctx.Err() != nil {
+		// the task has already timed out.
+		return &HostResult{
+			Host:     host,
+			ExitCode: resolveExitCode(ctx.Err()),
+			Err:      fmt.Errorf("timed out before running"),
+			TimedOut: true,
+		}
+	}
+
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+
+	r := &HostResult{Host: host}
+
+	start := time.Now()
+	err := fn(ctx, r)
+
+	r.ExitCode = resolveExitCode(err)
+	r.Duration = time.Since(start)
+	r.Err = err
+
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		r.TimedOut = true
+		r.Err = fmt.Errorf("timed out")
+	}
+
+	return r
+}
+
+// resolveExitCode returns the exit code of the script from the error of running it.
+func resolveExitCode(err error) int {
+	if code, ok := nativeExitCode(err); ok {
+		return code
+	}
+
+	// the error may wrap the error of the command like FileTransferError.
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return wrapcommander.ResolveExitCode(exitErr)
+	}
+
+	return wrapcommander.ResolveExitCode(err)
+}
+
+// newLHostResults converts the results to a lua table for the task's callbacks and essh.run_task.
+// The outputs are included only if capture is true.
+func newLHostResults(L *lua.LState, results []*HostResult, capture bool) *lua.LTable {
+	tb := L.NewTable()
+	for _, r := range results {
+		rtb := L.NewTable()
+		rtb.RawSetString("host", lua.LString(r.HostName()))
+		rtb.RawSetString("status", lua.LString(r.Status()))
+		rtb.RawSetString("exit_code", lua.LNumber(r.ExitCode))
+		rtb.RawSetString("duration", lua.LNumber(r.Duration.Seconds()))
+		if r.Err != nil {
+			rtb.RawSetString("error", lua.LString(r.Err.Error()))
+		}
+		if capture {
+			rtb.RawSetString("stdout", lua.LString(r.Stdout))
+			rtb.RawSetString("stderr", lua.LString(r.Stderr))
+		}
+		tb.Append(rtb)
+	}
+
+	return tb
+}
+
+// TaskError is returned when task's script failed on one or more hosts, or it stopped before running on all hosts.
+type TaskError struct {
+	Task    *Task
+	Results []*HostResult
+	// Stopped is the error that stopped running the remaining hosts like a canceled batch pause.
+	Stopped error
+}
+
+func (e *TaskError) Failed() []*HostResult {
+	failed := []*HostResult{}
+	for _, r := range e.Results {
+		if r.Failed() {
+			failed = append(failed, r)
+		}
+	}
+
+	return failed
+}
+
+func (e *TaskError) Error() string {
+	failed := e.Failed()
+	if e.Stopped != nil {
+		return fmt.Sprintf("task '%s' stopped before running on all hosts (failed on %d of %d hosts): %v", e.Task.Name, len(failed), len(e.Results), e.Stopped)
+	}
+	if len(e.Results) == 1 && len(failed) == 1 {
+		return failed[0].Err.Error()
+	}
+
+	return fmt.Sprintf("task '%s' failed on %d of %d hosts.", e.Task.Name, len(failed), len(e.Results))
+}
+
+// ExitStatus returns the exit code of the host for a single host run.
+// If the task succeeded on some hosts and failed on the others, it returns ExitPartialErr.
+func (e *TaskError) ExitStatus() int {
+	if len(e.Results) == 1 {
+		return e.Results[0].ExitCode
+	}
+
+	for _, r := range e.Results {
+		if !r.Failed() && !r.Aborted && !r.Skipped {
+			return ExitPartialErr
+		}
+	}
+
+	return ExitErr
+}
+
+func checkHostResults(task *Task, results []*HostResult) error {
+	for _, r := range results {
+		if r.Failed() {
+			return &TaskError{Task: task, Results: results}
+		}
+	}
+
+	return nil
+}
+
+func exitStatusFromError(err error) int {
+	// the error may wrap the TaskError like the error of a step.
+	var e *TaskError
+	if errors.As(err, &e) {
+		return e.ExitStatus()
+	}
+
+	return ExitErr
+}
+
+func printHostResults(w io.Writer, results []*HostResult) {
+	tb := helper.NewPlainTable(w)
+	tb.SetHeader([]string{"HOST", "STATUS", "EXIT", "DURATION", "ERROR"})
+	for _, r := range results {
+		exitStr, durationStr, errStr := "-", "-", ""
+		if !r.Aborted && !r.Skipped {
+			exitStr = strconv.Itoa(r.ExitCode)
+			durationStr = r.Duration.Round(time.Millisecond).String()
+		}
+		if r.Err != nil {
+			errStr = r.Err.Error()
+		}
+		tb.Append([]string{r.HostName(), r.Status(), exitStr, durationStr, errStr})
+	}
+	tb.Render()
+}
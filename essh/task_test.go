@@ -0,0 +1,73 @@
+package essh
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSerial(t *testing.T) {
+	cases := []struct {
+		serial string
+		total  int
+		sizes  []int
+		err    bool
+	}{
+		{serial: "", total: 10, sizes: []int{10}},
+		{serial: "3", total: 10, sizes: []int{3}},
+		{serial: "20", total: 10, sizes: []int{20}},
+		{serial: "20%", total: 10, sizes: []int{2}},
+		{serial: "25%", total: 10, sizes: []int{3}},
+		{serial: "1%", total: 10, sizes: []int{1}},
+		{serial: "100%", total: 10, sizes: []int{10}},
+		{serial: "50%", total: 0, sizes: []int{1}},
+		{serial: "1,20%", total: 10, sizes: []int{1, 2}},
+		{serial: "1, 2, 50%", total: 10, sizes: []int{1, 2, 5}},
+		{serial: "0", total: 10, err: true},
+		{serial: "-1", total: 10, err: true},
+		{serial: "0%", total: 10, err: true},
+		{serial: "101%", total: 10, err: true},
+		{serial: "150%", total: 10, err: true},
+		{serial: "abc", total: 10, err: true},
+		{serial: "%", total: 10, err: true},
+		{serial: "1,", total: 10, err: true},
+		{serial: "1,0%", total: 10, err: true},
+	}
+
+	for _, c := range cases {
+		sizes, err := parseSerial(c.serial, c.total)
+		if c.err {
+			if err == nil {
+				t.Errorf("parseSerial(%q, %d): expected an error, but got %v", c.serial, c.total, sizes)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSerial(%q, %d): unexpected error: %v", c.serial, c.total, err)
+			continue
+		}
+		if !reflect.DeepEqual(sizes, c.sizes) {
+			t.Errorf("parseSerial(%q, %d): expected %v, but got %v", c.serial, c.total, c.sizes, sizes)
+		}
+	}
+}
+
+func TestSplitBatches(t *testing.T) {
+	cases := []struct {
+		total   int
+		sizes   []int
+		batches [][]int
+	}{
+		{total: 5, sizes: []int{2}, batches: [][]int{{0, 1}, {2, 3}, {4}}},
+		{total: 3, sizes: []int{5}, batches: [][]int{{0, 1, 2}}},
+		{total: 6, sizes: []int{1, 2}, batches: [][]int{{0}, {1, 2}, {3, 4}, {5}}},
+		{total: 2, sizes: []int{1, 5, 10}, batches: [][]int{{0}, {1}}},
+		{total: 0, sizes: []int{1}, batches: [][]int{}},
+	}
+
+	for _, c := range cases {
+		batches := splitBatches(c.total, c.sizes)
+		if !reflect.DeepEqual(batches, c.batches) {
+			t.Errorf("splitBatches(%d, %v): expected %v, but got %v", c.total, c.sizes, c.batches, batches)
+		}
+	}
+}
@@ -7,6 +7,9 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
 )
 
 func userHomeDir() string {
@@ -72,3 +75,19 @@ func GetContentFromPath(shellPath string) ([]byte, error) {
 
 	return scriptContent, nil
 }
+
+// toDuration converts a lua value to time.Duration.
+// It accepts a string like "30s" or a number of seconds.
+func toDuration(v lua.LValue) (time.Duration, bool) {
+	if s, ok := toString(v); ok {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, false
+		}
+		return d, true
+	} else if f, ok := toFloat64(v); ok {
+		return time.Duration(f * float64(time.Second)), true
+	}
+
+	return 0, false
+}
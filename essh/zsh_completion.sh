@@ -37,6 +37,15 @@ _essh_tasks_global() {
     _describe -t task "task" __essh_tasks
 }
 
+_essh_task_params() {
+    local -a __essh_task_params
+    PRE_IFS=$IFS
+    IFS=$'\n'
+    __essh_task_params=($({{.Executable}} --zsh-completion-tasks "$1" | awk -F'\t' '{print $1":"$2}'))
+    IFS=$PRE_IFS
+    _describe -t param "parameter" __essh_task_params
+}
+
 _essh_tags() {
     local -a __essh_tags
     PRE_IFS=$IFS
@@ -73,6 +82,9 @@ _essh_options() {
 		'--eval-file:Evaluate lua script from file.'
         '--debug:Output debug log.'
         '--global:Force using global config.'
+        '--refresh-inventory:Fetch the hosts of the inventories again.'
+        '--import-ssh-config:Output hosts of the OpenSSH config file as lua code.'
+        '--export-inventory:Output hosts as an ansible inventory.'
         '--exec:Execute commands with the hosts.'
         '--zsh-completion:Output zsh completion code.'
         '--bash-completion:Output bash completion code.'
@@ -125,6 +137,8 @@ _essh_exec_options() {
         '--privileged:Run by the privileged user.'
         '--user:Run by the specific user.'
         '--parallel:Run in parallel.'
+        '--env:Export the environment variable to the scripts.'
+        '--group-output:Print identical outputs of the hosts once.'
         '--pty:Allocate pseudo-terminal. (add ssh option "-t -t" internally)'
         '--script-file:Load commands from a file.'
         '--driver:Specify a driver.'
@@ -236,6 +250,13 @@ _essh () {
                     elif [ "$tagsMode" = "on" ]; then
                         _essh_tags_options
                     else
+                        case $line[1] in
+                            -*)
+                                ;;
+                            *)
+                                _essh_task_params "$line[1]"
+                                ;;
+                        esac
                         _essh_options
                         _files
                     fi